@@ -0,0 +1,183 @@
+package kvdb
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// backup is a snapshot being copied by WriteTo. commits reuse the pages
+// freed after it was taken, so before a commit overwrites a page the backup
+// did not copy yet, the old content is preserved for the backup. this way
+// writers never wait for it
+type backup struct {
+	last      uint64          // last page of the snapshot
+	free      map[uint64]bool // free pages of the snapshot, copied as zeros
+	mu        sync.Mutex
+	copied    map[uint64]bool
+	preserved map[uint64][]byte
+	err       error
+}
+
+// WriteTo writes a consistent snapshot of the database to w. the snapshot
+// is taken when WriteTo starts, commits made while it is copied are not part
+// of it and do not wait for it. free pages are written as zeros
+func (db *DB) WriteTo(w io.Writer) (int64, error) {
+	bk, err := db.startBackup()
+	if err != nil {
+		return 0, err
+	}
+
+	defer db.stopBackup(bk)
+
+	var written int64
+	for pgid := uint64(0); pgid <= bk.last; pgid++ {
+		buf, err := bk.page(db, pgid)
+		if err != nil {
+			return written, err
+		}
+
+		n, err := w.Write(buf)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// CopyFile writes a consistent snapshot of the database to a new file at path
+func (db *DB) CopyFile(path string, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// startBackup takes the snapshot in a read-only transaction, so no commit
+// is half written, and registers the backup so commits preserve its pages
+func (db *DB) startBackup() (*backup, error) {
+	bk := &backup{
+		free:      make(map[uint64]bool),
+		copied:    make(map[uint64]bool),
+		preserved: make(map[uint64][]byte),
+	}
+
+	err := db.View(func(tx *Tx) error {
+		bk.last = db.meta.pgid
+		// the pages holding the freelist are not in it, they are copied
+		for _, pgid := range db.meta.freelist {
+			bk.free[pgid] = true
+		}
+
+		// commits write the meta copy the snapshot does not use, so the one
+		// it uses is kept now and the other is left zeroed
+		header := make([]byte, DB_HEADER)
+		offset := metaOffset(db.meta.txid)
+		_, err := db.file.ReadAt(header[offset:offset+META_PAGE_SIZE], offset)
+		if err != nil {
+			return err
+		}
+		bk.preserved[0] = header
+
+		db.backupsMu.Lock()
+		db.backups = append(db.backups, bk)
+		db.backupsMu.Unlock()
+
+		return nil
+	})
+
+	return bk, err
+}
+
+func (db *DB) stopBackup(bk *backup) {
+	db.backupsMu.Lock()
+	defer db.backupsMu.Unlock()
+
+	for i, other := range db.backups {
+		if other == bk {
+			db.backups = append(db.backups[:i], db.backups[i+1:]...)
+			break
+		}
+	}
+}
+
+// preserve is called by commits before they overwrite a page, it keeps the
+// old content for every backup that still needs it
+func (db *DB) preserve(pgid uint64) {
+	db.backupsMu.Lock()
+	defer db.backupsMu.Unlock()
+
+	for _, bk := range db.backups {
+		bk.preserve(db, pgid)
+	}
+}
+
+func (bk *backup) preserve(db *DB, pgid uint64) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+
+	if pgid > bk.last || bk.free[pgid] || bk.copied[pgid] {
+		return
+	}
+
+	if _, ok := bk.preserved[pgid]; ok {
+		return
+	}
+
+	buf, err := bk.read(db, pgid)
+	if err != nil {
+		bk.err = err
+		return
+	}
+
+	bk.preserved[pgid] = buf
+}
+
+// page returns the content the page had when the snapshot was taken
+func (bk *backup) page(db *DB, pgid uint64) ([]byte, error) {
+	bk.mu.Lock()
+	defer bk.mu.Unlock()
+
+	if bk.err != nil {
+		return nil, bk.err
+	}
+
+	bk.copied[pgid] = true
+
+	if bk.free[pgid] {
+		return make([]byte, PAGE_SIZE), nil
+	}
+
+	if buf, ok := bk.preserved[pgid]; ok {
+		delete(bk.preserved, pgid)
+		return buf, nil
+	}
+
+	return bk.read(db, pgid)
+}
+
+// read returns the page as it is on disk, pages never written are zeros.
+// the meta page is kept by startBackup
+func (bk *backup) read(db *DB, pgid uint64) ([]byte, error) {
+	buf := make([]byte, PAGE_SIZE)
+	_, err := db.file.ReadAt(buf, pageOffset(pgid))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,147 @@
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeHook calls fn before the first write, while the backup is running
+type writeHook struct {
+	w  *os.File
+	fn func()
+}
+
+func (h *writeHook) Write(p []byte) (int, error) {
+	if h.fn != nil {
+		h.fn()
+		h.fn = nil
+	}
+
+	return h.w.Write(p)
+}
+
+func TestDBWriteTo(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "numbers")
+	for i := 0; i < 200; i++ {
+		err = bucket.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bucket.DeleteRange([]byte("100"), []byte("150")); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writers must not wait for the backup, and must not change it
+	w := &writeHook{w: file, fn: func() {
+		for i := 0; i < 200; i++ {
+			err := bucket.Put([]byte(fmt.Sprintf("%03d", i)), []byte("changed"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mustBucket(t, db, "other").Put([]byte("key"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}}
+
+	if _, err := db.WriteTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := bucket.Get([]byte("000"))
+	if err != nil || string(value) != "changed" {
+		t.Fatalf("expected the writes during the backup to be committed but got %s, %v", value, err)
+	}
+
+	copied, err := Open(path, &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer copied.Close()
+
+	if problems := copied.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems in the backup but got %v", problems)
+	}
+
+	expected := []string{}
+	for i := 0; i < 200; i++ {
+		if i < 100 || i >= 150 {
+			expected = append(expected, fmt.Sprintf("%03d=%d", i, i))
+		}
+	}
+
+	keys := []string{}
+	mustBucket(t, copied, "numbers").Scan(func(key, value []byte) bool {
+		keys = append(keys, fmt.Sprintf("%s=%s", key, value))
+		return true
+	})
+
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Fatalf("expected the backup to hold the snapshot %v but got %v", expected, keys)
+	}
+
+	err = copied.View(func(tx *Tx) error {
+		if tx.Bucket("other") != nil {
+			t.Fatal("expected bucket created after the snapshot to be missing from the backup")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBCopyFile(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if err := mustBucket(t, db, "users").Put([]byte("Ahmed"), []byte("ahmed@email.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := db.CopyFile(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer copied.Close()
+
+	value, err := mustBucket(t, copied, "users").Get([]byte("Ahmed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(value, []byte("ahmed@email.com")) {
+		t.Fatalf("expected ahmed@email.com but got %s", value)
+	}
+}
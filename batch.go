@@ -0,0 +1,121 @@
+package kvdb
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errTrySolo is returned to a batch call whose function failed inside a
+// combined batch, it is then run again in a transaction of its own
+var errTrySolo = errors.New("batch function returned an error and should be re-run solo")
+
+// Batch runs fn as part of a batch. calls made from many goroutines within
+// Config.MaxBatchDelay of each other are grouped into one writable
+// transaction, so they share a single commit and a single fsync.
+//
+// if the batch fails, every function in it is retried in a transaction of
+// its own, so fn may run more than once and must be idempotent. Batch
+// returns the error of fn, or of the transaction that committed it
+func (db *DB) Batch(fn func(*Tx) error) error {
+	errCh := make(chan error, 1)
+
+	db.batchMu.Lock()
+	if db.batch == nil || len(db.batch.calls) >= db.config.MaxBatchSize {
+		// there is no batch waiting for calls, start a new one
+		db.batch = &batch{db: db}
+		db.batch.timer = time.AfterFunc(db.config.MaxBatchDelay, db.batch.trigger)
+	}
+	db.batch.calls = append(db.batch.calls, call{fn: fn, err: errCh})
+	if len(db.batch.calls) >= db.config.MaxBatchSize {
+		// the batch is full, run it right away
+		go db.batch.trigger()
+	}
+	db.batchMu.Unlock()
+
+	err := <-errCh
+	if err == errTrySolo {
+		err = db.Update(fn)
+	}
+
+	return err
+}
+
+type call struct {
+	fn  func(*Tx) error
+	err chan<- error
+}
+
+type batch struct {
+	db    *DB
+	timer *time.Timer
+	start sync.Once
+	calls []call
+}
+
+// trigger runs the batch if it has not run yet
+func (b *batch) trigger() {
+	b.start.Do(b.run)
+}
+
+// run commits the batch and reports the result to every call
+func (b *batch) run() {
+	b.db.batchMu.Lock()
+	b.timer.Stop()
+	// no new calls can join the batch from now on
+	if b.db.batch == b {
+		b.db.batch = nil
+	}
+	b.db.batchMu.Unlock()
+
+	for len(b.calls) > 0 {
+		failIdx := -1
+		err := b.db.Update(func(tx *Tx) error {
+			for i, c := range b.calls {
+				if err := safelyCall(c.fn, tx); err != nil {
+					failIdx = i
+					return err
+				}
+			}
+			return nil
+		})
+
+		if failIdx >= 0 {
+			// take the failing call out of the batch and let it retry on its
+			// own, then run the rest of the batch again
+			c := b.calls[failIdx]
+			b.calls[failIdx], b.calls = b.calls[len(b.calls)-1], b.calls[:len(b.calls)-1]
+			c.err <- errTrySolo
+			continue
+		}
+
+		for _, c := range b.calls {
+			c.err <- err
+		}
+
+		break
+	}
+}
+
+// panicked wraps the value of a panic raised by a batch function
+type panicked struct {
+	reason interface{}
+}
+
+func (p panicked) Error() string {
+	if err, ok := p.reason.(error); ok {
+		return err.Error()
+	}
+
+	return "panic"
+}
+
+func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = panicked{p}
+		}
+	}()
+
+	return fn(tx)
+}
@@ -1,22 +1,107 @@
 package kvdb
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrKeyNotFound is returned when a key that must exist does not
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrKeyTooLarge is returned when writing a key longer than MaxKeySize
+	ErrKeyTooLarge = errors.New("key too large")
+	// ErrValueTooLarge is returned when writing a key and value that do not
+	// fit in a page together
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// MaxKeySize is the maximum length of a key, internal nodes must fit a full
+// node of keys in a page
+const MaxKeySize = 1024
+
+// checkSize returns an error if key and value cannot be written to a leaf
+func checkSize(key []byte, value []byte) error {
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+
+	if !fitsLeaf(len(key), len(value)) {
+		return ErrValueTooLarge
+	}
+
+	return nil
+}
+
+// fitsLeaf reports whether a key and a value of the given sizes fit in a
+// leaf on their own
+func fitsLeaf(keySize int, valueSize int) bool {
+	return nodeHeaderSize+2+keySize+4+valueSize <= PAGE_SIZE
+}
+
+// checkSize returns an error if key and value, or the entries the bucket
+// derives from them when they are written, cannot be written to a leaf
+func (b *Bucket) checkSize(key []byte, value []byte) error {
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
+
+	if err := b.checkIndexSize(key, value); err != nil {
+		return err
+	}
+
+	if b.db.config.ChangeLog && !isInternalBucket(b.name) {
+		return checkChangeSize(b.name, key, value)
+	}
+
+	return nil
+}
 
 type Bucket struct {
+	*bucket
+	tx *Tx // transaction the handle is bound to, nil for handles returned by DB.Bucket
+}
+
+// bucket is the tree state shared by every handle of the same bucket
+type bucket struct {
 	db    *DB
+	name  string
 	root  uint64
 	nodes map[uint64]*Node // in-memory nodes
+	mu    sync.Mutex       // guards nodes against concurrent readers
+
+	sequential bool                 // keys are inserted in order, see Node.splitMid
+	comparator Comparator           // orders the keys, bytes.Compare when it has no Compare
+	indexes    map[string]IndexFunc // indexes updated on every change, see CreateIndex
 }
 
-func newBucket(db *DB, pgid uint64) *Bucket {
-	return &Bucket{
-		db:    db,
-		root:  pgid,
-		nodes: make(map[uint64]*Node),
+func newBucket(db *DB, name string, pgid uint64) *bucket {
+	return &bucket{
+		db:         db,
+		name:       name,
+		root:       pgid,
+		nodes:      make(map[uint64]*Node),
+		comparator: db.comparators[name],
 	}
 }
 
 func (b *Bucket) Put(key []byte, value []byte) error {
+	if err := b.checkSize(key, value); err != nil {
+		return err
+	}
+
+	return b.update(func(b *Bucket) error {
+		b.forget(key)
+		b.put(key, value)
+		return nil
+	})
+}
+
+func (b *Bucket) put(key []byte, value []byte) {
+	b.count(&b.db.counters.putN, 1)
+
 	cursor := b.Cursor()
 
 	// get node where key should be inserted
@@ -25,44 +110,72 @@ func (b *Bucket) Put(key []byte, value []byte) error {
 	// if key already exists, update value
 	// if key does not exist, the value is -1
 	if i, ok := node.findKey(key); ok {
+		b.changed(EventPut, key, node.values[i], value)
 		node.values[i] = value
-		return nil
+		node.dirty = true
+	} else {
+		// insert key and value
+		b.changed(EventPut, key, nil, value)
+		node.insert(key, value)
 	}
 
-	// insert key and value
-	node.insert(key, value)
+	// if node is full, split it, the parents are split with it
+	node.split()
+}
 
-	// if node is full, split it
-	// @todo: this logic should be moved to commit transaction function
-	// but for now, we will keep it here
-	for i := len(cursor.stack) - 1; i >= 0; i-- {
-		// split every node that is full in the stack
-		if b.db.config.callOnSplit != nil {
-			b.db.config.callOnSplit()
-		}
-		cursor.stack[i].split()
+func (b *Bucket) Update(key []byte, value []byte) error {
+	if err := b.checkSize(key, value); err != nil {
+		return err
 	}
-	//node.split()
 
-	return nil
-}
+	return b.update(func(b *Bucket) error {
+		cursor := b.Cursor()
 
-func (b *Bucket) Update(key []byte, value []byte) error {
-	cursor := b.Cursor()
+		// get node where key should be
+		node := cursor.seek(key)
 
-	// get node where key should be
-	node := cursor.seek(key)
+		// if key  exists, update value
+		if i, ok := node.findKey(key); ok && !b.expired(key) {
+			b.forget(key)
+			b.changed(EventPut, key, node.values[i], value)
+			node.values[i] = value
+			node.dirty = true
+			node.split()
+			return nil
+		}
+
+		return ErrKeyNotFound
+	})
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.view(func(b *Bucket) error {
+		var ok bool
+		if value, ok = b.get(key); !ok {
+			return ErrKeyNotFound
+		}
 
-	// if key  exists, update value
-	if i, ok := node.findKey(key); ok {
-		node.values[i] = value
 		return nil
+	})
+
+	return value, err
+}
+
+// get returns the value of key, keys that expired are treated as missing
+func (b *Bucket) get(key []byte) ([]byte, bool) {
+	b.count(&b.db.counters.getN, 1)
+
+	value, ok := b.lookup(key)
+	if !ok || b.expired(key) {
+		return nil, false
 	}
 
-	return fmt.Errorf("key not found")
+	return value, true
 }
 
-func (b *Bucket) Get(key []byte) ([]byte, error) {
+// lookup returns the value of key as stored in the tree
+func (b *Bucket) lookup(key []byte) ([]byte, bool) {
 	cursor := b.Cursor()
 
 	// get node where key should be
@@ -70,13 +183,94 @@ func (b *Bucket) Get(key []byte) ([]byte, error) {
 
 	// if key exists, return value
 	if i, ok := node.findKey(key); ok {
-		return node.values[i], nil
+		return node.values[i], true
+	}
+
+	return nil, false
+}
+
+// CompareAndSwap replaces the value of key with new only if its current
+// value is old. it reports whether the value was replaced, a missing key is
+// never replaced
+func (b *Bucket) CompareAndSwap(key []byte, old []byte, new []byte) (bool, error) {
+	if err := b.checkSize(key, new); err != nil {
+		return false, err
+	}
+
+	var swapped bool
+	err := b.update(func(b *Bucket) error {
+		value, ok := b.get(key)
+		if !ok || !bytes.Equal(value, old) {
+			return nil
+		}
+
+		b.forget(key)
+		b.put(key, new)
+		swapped = true
+
+		return nil
+	})
+
+	return swapped, err
+}
+
+// PutIfAbsent writes value only if key does not exist yet. it reports
+// whether the value was written
+func (b *Bucket) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	if err := b.checkSize(key, value); err != nil {
+		return false, err
 	}
 
-	return nil, fmt.Errorf("key not found")
+	var written bool
+	err := b.update(func(b *Bucket) error {
+		if _, ok := b.get(key); ok {
+			return nil
+		}
+
+		b.forget(key)
+		b.put(key, value)
+		written = true
+
+		return nil
+	})
+
+	return written, err
+}
+
+// DeleteIfEquals removes key only if its current value is old. it reports
+// whether the key was removed
+func (b *Bucket) DeleteIfEquals(key []byte, old []byte) (bool, error) {
+	var deleted bool
+	err := b.update(func(b *Bucket) error {
+		value, ok := b.get(key)
+		if !ok || !bytes.Equal(value, old) {
+			return nil
+		}
+
+		b.forget(key)
+		deleted = b.delete(key)
+
+		return nil
+	})
+
+	return deleted, err
 }
 
 func (b *Bucket) Delete(key []byte) error {
+	return b.update(func(b *Bucket) error {
+		b.forget(key)
+		if !b.delete(key) {
+			return ErrKeyNotFound
+		}
+
+		return nil
+	})
+}
+
+// delete removes key from the tree and reports whether it was there
+func (b *Bucket) delete(key []byte) bool {
+	b.count(&b.db.counters.deleteN, 1)
+
 	cursor := b.Cursor()
 
 	// get node where key should be
@@ -84,38 +278,282 @@ func (b *Bucket) Delete(key []byte) error {
 
 	// if key exists, delete it
 	if i, ok := node.findKey(key); ok {
+		b.changed(EventDelete, key, node.values[i], nil)
 		node.delete(i)
-		b.node(node.parent).possibleFree(node.pgid)
+		// the root leaf has no parent to be removed from
+		if node.parent != 0 {
+			b.node(node.parent).possibleFree(node.pgid)
+		}
+		return true
+	}
+
+	return false
+}
+
+// NextSequence increments the sequence of the bucket and returns it. the
+// first call returns 1. the sequence is stored with the bucket, so it only
+// moves forward when the transaction it runs in commits
+func (b *Bucket) NextSequence() (uint64, error) {
+	var sequence uint64
+	err := b.update(func(b *Bucket) error {
+		record := b.db.meta.record(b.name)
+		record.sequence++
+		sequence = record.sequence
+
+		return nil
+	})
+
+	return sequence, err
+}
+
+// SetSequence sets the sequence of the bucket, the next call to
+// NextSequence returns n+1
+func (b *Bucket) SetSequence(n uint64) error {
+	return b.update(func(b *Bucket) error {
+		b.db.meta.record(b.name).sequence = n
+		return nil
+	})
+}
+
+// Sequence returns the current sequence of the bucket without changing it
+func (b *Bucket) Sequence() (uint64, error) {
+	var sequence uint64
+	err := b.view(func(b *Bucket) error {
+		sequence = b.db.meta.record(b.name).sequence
+		return nil
+	})
+
+	return sequence, err
+}
+
+// DeleteRange removes every key in [start, end) and returns how many were
+// removed. an empty start or end leaves the range open on that side. pages
+// left without keys are given back to the freelist
+func (b *Bucket) DeleteRange(start []byte, end []byte) (int, error) {
+	var count int
+	err := b.update(func(b *Bucket) error {
+		b.forgetRange(start, end)
+		count = b.deleteRange(start, end)
+		return nil
+	})
+
+	return count, err
+}
+
+// DeletePrefix removes every key starting with prefix and returns how many
+// were removed
+func (b *Bucket) DeletePrefix(prefix []byte) (int, error) {
+	if b.comparator.Compare == nil {
+		return b.DeleteRange(prefix, prefixEnd(prefix))
+	}
+
+	// the keys of a prefix are not next to each other with a comparator,
+	// every key is looked at
+	var count int
+	err := b.update(func(b *Bucket) error {
+		var keys [][]byte
+		b.node(b.root).scan(func(key []byte, value []byte) bool {
+			if bytes.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+
+		for _, key := range keys {
+			b.forget(key)
+			b.delete(key)
+		}
+		count = len(keys)
+
 		return nil
+	})
+
+	return count, err
+}
+
+func (b *Bucket) deleteRange(start []byte, end []byte) int {
+	if len(start) == 0 {
+		start = nil
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+
+	root := b.node(b.root)
+	if b.tx.recording || len(b.indexes) > 0 {
+		root.scanRange(start, end, func(key []byte, value []byte) bool {
+			b.changed(EventDelete, key, value, nil)
+			return true
+		})
+	}
+
+	count := root.deleteRange(start, end)
+	b.count(&b.db.counters.deleteN, count)
+
+	// the root lost all of its children, so the bucket is empty again
+	if root.typ == NODE_TYPE_INTERNAL && root.isEmpty() {
+		root.becomeEmptyLeaf()
+	}
+
+	return count
+}
+
+// count adds n to the counter unless the bucket is one the database keeps
+// for itself, so Stats only counts what users do
+func (b *Bucket) count(counter *atomic.Int64, n int) {
+	if !isInternalBucket(b.name) {
+		counter.Add(int64(n))
+	}
+}
+
+// prefixEnd returns the first key after every key starting with prefix,
+// or nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
 	}
 
-	return fmt.Errorf("key not found")
+	return nil
 }
 
 func (b *Bucket) Cursor() Cursor {
 	return newCursor(b)
 }
 
+// update runs fn against a writable handle of the bucket. handles that are
+// not bound to a transaction run fn in a transaction of their own
+func (b *Bucket) update(fn func(*Bucket) error) (err error) {
+	if b.tx == nil {
+		return b.db.Update(func(tx *Tx) error {
+			return tx.Bucket(b.name).update(fn)
+		})
+	}
+
+	if b.tx.done {
+		return ErrTxClosed
+	}
+
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+
+	defer recoverReadError(&err)
+
+	return fn(b)
+}
+
+// view runs fn against a readable handle of the bucket. handles that are
+// not bound to a transaction run fn in a read-only transaction of their own
+func (b *Bucket) view(fn func(*Bucket) error) (err error) {
+	if b.tx == nil {
+		return b.db.View(func(tx *Tx) error {
+			return tx.Bucket(b.name).view(fn)
+		})
+	}
+
+	if b.tx.done {
+		return ErrTxClosed
+	}
+
+	defer recoverReadError(&err)
+
+	return fn(b)
+}
+
 // node returns the in-memory node for a given page id
 // if node is not found in cache, it is loaded from disk
-// if node is not found on disk, it is created in memory
-// and will be persisted to disk when the bucket finishes writing
+// an empty root that was never written is created in memory
 func (b *Bucket) node(pgid uint64) *Node {
+	return b.load(pgid, 0)
+}
+
+// load returns the node like node, a node read from disk gets parent as its
+// parent since parents are not stored
+func (b *Bucket) load(pgid uint64, parent uint64) *Node {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	if node, ok := b.nodes[pgid]; ok {
+		b.db.counters.cacheHitN.Add(1)
 		return node
 	}
 
-	// @todo: load node from disk and cache it in memory if found
-
-	node := newNode(b, pgid, NODE_TYPE_LEAF)
+	b.db.counters.cacheMissN.Add(1)
+	node, err := b.db.readNode(b, pgid)
+	switch {
+	case errors.Is(err, errPageNotWritten) && pgid == b.root:
+		// the root of an empty bucket may never have been written
+		node = newNode(b, pgid, NODE_TYPE_LEAF)
+	case err != nil:
+		panic(readError{err})
+	}
+	node.parent = parent
 
 	b.nodes[pgid] = node
 
 	return node
 }
 
+// spill moves the dirty nodes on pages the file uses to new pages, so a
+// commit never overwrites what the last commit wrote. the parent of a moved
+// node points to the new page and is moved as well, up to the root
+func (b *Bucket) spill() {
+	for {
+		var moving []*Node
+		for _, node := range b.nodes {
+			if node.dirty && !b.db.meta.isAllocated(node.pgid) {
+				moving = append(moving, node)
+			}
+		}
+		if len(moving) == 0 {
+			return
+		}
+
+		sort.Slice(moving, func(i, j int) bool { return moving[i].pgid < moving[j].pgid })
+		for _, node := range moving {
+			b.move(node)
+		}
+	}
+}
+
+// move gives the node a new page and frees the old one
+func (b *Bucket) move(n *Node) {
+	old := n.pgid
+	n.pgid = b.db.allocate()
+
+	b.mu.Lock()
+	delete(b.nodes, old)
+	b.nodes[n.pgid] = n
+	for _, child := range n.children {
+		if node, ok := b.nodes[child]; ok {
+			node.parent = n.pgid
+		}
+	}
+	b.mu.Unlock()
+
+	b.freePage(old)
+
+	if old == b.root {
+		b.root = n.pgid
+		return
+	}
+
+	parent := b.node(n.parent)
+	for i, child := range parent.children {
+		if child == old {
+			parent.children[i] = n.pgid
+		}
+	}
+	parent.dirty = true
+}
+
 func (b *Bucket) newRootNode() *Node {
-	node := newNode(b, b.db.meta.getNewPageID(), NODE_TYPE_INTERNAL)
+	node := newNode(b, b.db.allocate(), NODE_TYPE_INTERNAL)
+	node.dirty = true
 
 	b.nodes[node.pgid] = node
 	b.root = node.pgid
@@ -124,7 +562,8 @@ func (b *Bucket) newRootNode() *Node {
 }
 
 func (b *Bucket) newInternalNode() *Node {
-	node := newNode(b, b.db.meta.getNewPageID(), NODE_TYPE_INTERNAL)
+	node := newNode(b, b.db.allocate(), NODE_TYPE_INTERNAL)
+	node.dirty = true
 
 	b.nodes[node.pgid] = node
 
@@ -132,7 +571,8 @@ func (b *Bucket) newInternalNode() *Node {
 }
 
 func (b Bucket) newLeafNode() *Node {
-	node := newNode(&b, b.db.meta.getNewPageID(), NODE_TYPE_LEAF)
+	node := newNode(&b, b.db.allocate(), NODE_TYPE_LEAF)
+	node.dirty = true
 
 	b.nodes[node.pgid] = node
 
@@ -140,7 +580,8 @@ func (b Bucket) newLeafNode() *Node {
 }
 
 func (b *Bucket) newNode(parent uint64, typ uint8) *Node {
-	node := newNode(b, b.db.meta.getNewPageID(), typ)
+	node := newNode(b, b.db.allocate(), typ)
+	node.dirty = true
 
 	node.parent = parent
 
@@ -149,6 +590,90 @@ func (b *Bucket) newNode(parent uint64, typ uint8) *Node {
 	return node
 }
 
-func (b *Bucket) Scan(f func(key []byte, value []byte) bool) {
-	b.node(b.root).scan(f)
+// Scan calls f for every key in order until f returns false. it returns
+// an error if a page cannot be read
+func (b *Bucket) Scan(f func(key []byte, value []byte) bool) error {
+	return b.ScanRange(nil, nil, f)
+}
+
+// ScanRange calls f for every key in [start, end) in order until f returns
+// false. an empty start or end leaves the range open on that side
+func (b *Bucket) ScanRange(start []byte, end []byte, f func(key []byte, value []byte) bool) error {
+	return b.scanRange(start, end, false, f)
+}
+
+// ScanRangeReverse calls f for every key in [start, end) from the last one
+// until f returns false. an empty start or end leaves the range open on that
+// side
+func (b *Bucket) ScanRangeReverse(start []byte, end []byte, f func(key []byte, value []byte) bool) error {
+	return b.scanRange(start, end, true, f)
+}
+
+func (b *Bucket) scanRange(start []byte, end []byte, reverse bool, f func(key []byte, value []byte) bool) error {
+	if len(start) == 0 {
+		start = nil
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+
+	return b.view(func(b *Bucket) error {
+		root := b.node(b.root)
+		scan := root.scanRange
+		if reverse {
+			scan = root.scanRangeReverse
+		}
+
+		scan(start, end, func(key []byte, value []byte) bool {
+			// skip keys that expired but were not swept yet
+			if b.expired(key) {
+				return true
+			}
+			return f(key, value)
+		})
+		return nil
+	})
+}
+
+// ScanPrefix calls f for every key starting with prefix in order until f
+// returns false
+func (b *Bucket) ScanPrefix(prefix []byte, f func(key []byte, value []byte) bool) error {
+	return b.ScanPrefixRange(prefix, nil, nil, f)
+}
+
+// ScanPrefixRange calls f for every key starting with prefix in [start, end)
+// in order until f returns false. start and end are compared in the order
+// of the bucket, so listings can be paged with the last key returned
+func (b *Bucket) ScanPrefixRange(prefix []byte, start []byte, end []byte, f func(key []byte, value []byte) bool) error {
+	return b.scanPrefixRange(prefix, start, end, false, f)
+}
+
+// ScanPrefixRangeReverse is ScanPrefixRange from the last key
+func (b *Bucket) ScanPrefixRangeReverse(prefix []byte, start []byte, end []byte, f func(key []byte, value []byte) bool) error {
+	return b.scanPrefixRange(prefix, start, end, true, f)
+}
+
+func (b *Bucket) scanPrefixRange(prefix []byte, start []byte, end []byte, reverse bool, f func(key []byte, value []byte) bool) error {
+	if len(prefix) == 0 {
+		return b.scanRange(start, end, reverse, f)
+	}
+
+	if b.comparator.Compare == nil {
+		// the keys starting with prefix are a range in byte order
+		if bytes.Compare(start, prefix) < 0 {
+			start = prefix
+		}
+		if last := prefixEnd(prefix); last != nil && (len(end) == 0 || bytes.Compare(end, last) > 0) {
+			end = last
+		}
+		if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+			return nil
+		}
+
+		return b.scanRange(start, end, reverse, f)
+	}
+
+	return b.scanRange(start, end, reverse, func(key []byte, value []byte) bool {
+		return !bytes.HasPrefix(key, prefix) || f(key, value)
+	})
 }
@@ -0,0 +1,238 @@
+package kvdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrChangesTruncated is returned by ChangesSince when changes after the
+// requested sequence were already removed by TruncateChanges
+var ErrChangesTruncated = errors.New("changes truncated")
+
+// with Config.ChangeLog every change of a user bucket is appended to an
+// internal bucket when its transaction commits
+//
+//	changes bucket: sequence -> change
+//	                sequence, 0 -> value before the change
+//
+// the sequence is the one of the bucket, 8 bytes big endian so changes sort
+// in commit order. it only grows, so a sequence tells where a reader stopped
+// even after the changes before it were truncated. the value before a change
+// is kept in a key of its own, so a change holding two values still fits in
+// a leaf
+
+const changeLogBucketName = internalBucketPrefix + "changes"
+
+const (
+	changeHasBefore = 1 << 0
+	changeHasAfter  = 1 << 1
+)
+
+// logChanges appends the changes of the transaction to the change log and
+// numbers them. it is called by Commit before the nodes are written
+func (tx *Tx) logChanges() (err error) {
+	if len(tx.changes) == 0 {
+		return nil
+	}
+
+	defer recoverReadError(&err)
+
+	log := tx.bucket(changeLogBucketName, true)
+	record := tx.db.meta.record(changeLogBucketName)
+
+	for i := range tx.changes {
+		record.sequence++
+		tx.changes[i].Seq = record.sequence
+		log.put(encodeSequence(record.sequence), encodeChange(tx.changes[i]))
+		if tx.changes[i].Before != nil {
+			log.put(beforeKey(record.sequence), tx.changes[i].Before)
+		}
+	}
+
+	return nil
+}
+
+// checkChangeSize returns ErrValueTooLarge if the change log cannot hold a
+// put of key and value in bucket, or a later change of key with value as
+// the value before it
+func checkChangeSize(bucket string, key []byte, value []byte) error {
+	// the record of the put, see encodeChange
+	size := binary.MaxVarintLen64 + 2 + uvarintSize(len(bucket)) + len(bucket) +
+		uvarintSize(len(key)) + len(key) + uvarintSize(len(value)) + len(value)
+	if !fitsLeaf(8, size) || !fitsLeaf(9, len(value)) {
+		return ErrValueTooLarge
+	}
+
+	return nil
+}
+
+// ChangesSince calls f with every change in the change log after seq, in
+// commit order, until f returns false. pass the Seq of the last change a
+// reader handled to resume after it, or 0 to read the log from the start.
+// it returns ErrChangesTruncated if some changes after seq were removed.
+//
+// changes are only logged while the database is opened with
+// Config.ChangeLog, f runs in a read-only transaction so it must not write
+// to the database
+func (db *DB) ChangesSince(seq uint64, f func(Event) bool) error {
+	return db.View(func(tx *Tx) (err error) {
+		defer recoverReadError(&err)
+
+		log := tx.bucket(changeLogBucketName, false)
+		if log == nil {
+			return nil
+		}
+
+		start := encodeSequence(seq + 1)
+		first := true
+		// a change waiting for the value before it, which follows it
+		var pending *Event
+		log.node(log.root).scanRange(start, nil, func(key []byte, value []byte) bool {
+			next := binary.BigEndian.Uint64(key)
+			if len(key) > 8 {
+				if pending == nil || pending.Seq != next {
+					err = fmt.Errorf("invalid change %d in the change log, no change for the value before it", next)
+					return false
+				}
+				pending.Before = value
+				event := *pending
+				pending = nil
+				return f(event)
+			}
+			if pending != nil {
+				err = fmt.Errorf("invalid change %d in the change log, the value before it is missing", pending.Seq)
+				return false
+			}
+
+			if first && next != seq+1 {
+				err = ErrChangesTruncated
+				return false
+			}
+			first = false
+
+			var event Event
+			var hasBefore bool
+			if event, hasBefore, err = decodeChange(next, value); err != nil {
+				return false
+			}
+			if hasBefore {
+				pending = &event
+				return true
+			}
+
+			return f(event)
+		})
+		if err == nil && pending != nil {
+			err = fmt.Errorf("invalid change %d in the change log, the value before it is missing", pending.Seq)
+		}
+		if err != nil {
+			return err
+		}
+
+		// every change after seq was truncated
+		if first && db.meta.record(changeLogBucketName).sequence > seq {
+			return ErrChangesTruncated
+		}
+
+		return nil
+	})
+}
+
+// TruncateChanges removes the changes up to seq from the change log, once
+// every reader handled them. sequences are not reused, later changes keep
+// numbering from where the log was
+func (db *DB) TruncateChanges(seq uint64) error {
+	if seq == 0 {
+		return nil
+	}
+
+	return db.Update(func(tx *Tx) (err error) {
+		defer recoverReadError(&err)
+
+		log := tx.bucket(changeLogBucketName, false)
+		if log == nil {
+			return nil
+		}
+
+		log.deleteRange(nil, encodeSequence(seq+1))
+
+		return nil
+	})
+}
+
+func encodeSequence(seq uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, seq)
+	return buf
+}
+
+// beforeKey is the key of the value before the change seq, it sorts right
+// after the change
+func beforeKey(seq uint64) []byte {
+	return append(encodeSequence(seq), 0)
+}
+
+// encodeChange encodes a change as
+//
+//	txid, type, flags, bucket name, key, after if set
+//
+// with the txid as a uvarint and the byte slices prefixed by their length.
+// flags tell a missing before or after apart from an empty one, the value
+// before is not encoded
+func encodeChange(event Event) []byte {
+	var flags byte
+	if event.Before != nil {
+		flags |= changeHasBefore
+	}
+	if event.After != nil {
+		flags |= changeHasAfter
+	}
+
+	buf := binary.AppendUvarint(nil, event.TxID)
+	buf = append(buf, byte(event.Type), flags)
+	buf = appendBytes(buf, []byte(event.Bucket))
+	buf = appendBytes(buf, event.Key)
+	if event.After != nil {
+		buf = appendBytes(buf, event.After)
+	}
+
+	return buf
+}
+
+// decodeChange decodes a change encoded by encodeChange and reports whether
+// it had a value before, which is stored apart
+func decodeChange(seq uint64, data []byte) (Event, bool, error) {
+	invalid := fmt.Errorf("invalid change %d in the change log", seq)
+
+	txid, n := binary.Uvarint(data)
+	if n <= 0 || len(data) < n+2 {
+		return Event{}, false, invalid
+	}
+
+	event := Event{Seq: seq, TxID: txid, Type: EventType(data[n])}
+	flags := data[n+1]
+	data = data[n+2:]
+
+	var bucket []byte
+	var err error
+	if bucket, data, err = readBytes(data); err != nil {
+		return Event{}, false, fmt.Errorf("%v, bucket: %w", invalid, err)
+	}
+	event.Bucket = string(bucket)
+
+	if event.Key, data, err = readBytes(data); err != nil {
+		return Event{}, false, fmt.Errorf("%v, key: %w", invalid, err)
+	}
+	if flags&changeHasAfter != 0 {
+		if event.After, data, err = readBytes(data); err != nil {
+			return Event{}, false, fmt.Errorf("%v, value: %w", invalid, err)
+		}
+	}
+
+	if len(data) > 0 {
+		return Event{}, false, invalid
+	}
+
+	return event, flags&changeHasBefore != 0, nil
+}
@@ -0,0 +1,206 @@
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func readChanges(t *testing.T, db *DB, seq uint64) []string {
+	var changes []string
+	err := db.ChangesSince(seq, func(event Event) bool {
+		changes = append(changes, fmt.Sprintf("%d tx%d %s %s %s %q -> %q", event.Seq, event.TxID, event.Bucket, map[EventType]string{EventPut: "put", EventDelete: "del"}[event.Type], event.Key, event.Before, event.After))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return changes
+}
+
+func TestDBChangesSince(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 2, ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "users")
+	if err := bucket.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Update([]byte("a"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	db.Update(func(tx *Tx) error {
+		tx.Bucket("users").Put([]byte("z"), []byte("rolled back"))
+		return errAbort
+	})
+
+	err = db.Update(func(tx *Tx) error {
+		b := tx.Bucket("users")
+		if err := b.Put([]byte("b"), []byte("3")); err != nil {
+			return err
+		}
+		return b.Delete([]byte("a"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Config{maxKeysPerNode: 2, ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	expected := []string{
+		`1 tx2 users put a "" -> "1"`,
+		`2 tx3 users put a "1" -> "2"`,
+		`3 tx4 users put b "" -> "3"`,
+		`4 tx4 users del a "2" -> ""`,
+	}
+	changes := readChanges(t, db, 0)
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Fatalf("expected changes %q but got %q", expected, changes)
+	}
+
+	// resume after the last change read
+	if err := mustBucket(t, db, "users").Put([]byte("c"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	changes = readChanges(t, db, 4)
+	if len(changes) != 1 || changes[0] != `5 tx5 users put c "" -> "4"` {
+		t.Fatalf("expected the change after 4 but got %q", changes)
+	}
+
+	// the log is not a user bucket
+	if buckets := db.Buckets(); len(buckets) != 1 {
+		t.Fatalf("expected only the users bucket but got %v", buckets)
+	}
+
+	if err := db.TruncateChanges(3); err != nil {
+		t.Fatal(err)
+	}
+
+	changes = readChanges(t, db, 3)
+	if len(changes) != 2 {
+		t.Fatalf("expected the changes after 3 but got %q", changes)
+	}
+
+	err = db.ChangesSince(1, func(Event) bool { return true })
+	if !errors.Is(err, ErrChangesTruncated) {
+		t.Fatalf("expected ErrChangesTruncated but got %v", err)
+	}
+
+	if err := db.TruncateChanges(5); err != nil {
+		t.Fatal(err)
+	}
+	if changes := readChanges(t, db, 5); len(changes) != 0 {
+		t.Fatalf("expected no changes but got %q", changes)
+	}
+	err = db.ChangesSince(4, func(Event) bool { return true })
+	if !errors.Is(err, ErrChangesTruncated) {
+		t.Fatalf("expected ErrChangesTruncated but got %v", err)
+	}
+
+	// sequences keep growing after a truncation
+	if err := mustBucket(t, db, "users").Put([]byte("d"), []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	changes = readChanges(t, db, 5)
+	if len(changes) != 1 || changes[0] != `6 tx8 users put d "" -> "5"` {
+		t.Fatalf("expected change 6 but got %q", changes)
+	}
+}
+
+func TestDBChangesSinceWithoutLog(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if err := mustBucket(t, db, "users").Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := readChanges(t, db, 0); len(changes) != 0 {
+		t.Fatalf("expected no changes but got %q", changes)
+	}
+}
+
+func TestDBChangesLargeValues(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the change of the second put holds both values
+	bucket := mustBucket(t, db, "users")
+	first := bytes.Repeat([]byte("a"), 3000)
+	second := bytes.Repeat([]byte("b"), 3000)
+	if err := bucket.Put([]byte("user"), first); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("user"), second); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []Event
+	err = db.ChangesSince(0, func(event Event) bool {
+		events = append(events, event)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Before != nil || !bytes.Equal(events[1].Before, first) || !bytes.Equal(events[1].After, second) {
+		t.Fatalf("expected the two puts with their values but got %d events", len(events))
+	}
+
+	// the key leaves no room for the record of the change
+	if err := bucket.Put([]byte("user"), bytes.Repeat([]byte("c"), PAGE_SIZE-nodeHeaderSize-20)); err != ErrValueTooLarge {
+		t.Fatalf("expected ErrValueTooLarge but got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a change log page that cannot be read fails the commit
+	flipByte(t, path, db.meta.record(changeLogBucketName).rootpage, PAGE_SIZE-1)
+
+	db, err = Open(path, &Config{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var mismatch ErrChecksumMismatch
+	if err := mustBucket(t, db, "users").Put([]byte("user"), []byte("d")); !errors.As(err, &mismatch) {
+		t.Fatalf("expected ErrChecksumMismatch but got %v", err)
+	}
+}
+
+func TestDecodeChangeCutShort(t *testing.T) {
+	data := encodeChange(Event{TxID: 1, Type: EventPut, Bucket: "users", Key: []byte("a"), After: []byte("1")})
+
+	_, _, err := decodeChange(7, data[:len(data)-1])
+	if !errors.Is(err, errShortBuffer) || !strings.Contains(err.Error(), "change 7") {
+		t.Fatalf("expected the change to be cut short but got %v", err)
+	}
+}
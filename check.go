@@ -0,0 +1,208 @@
+package kvdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Check reads every page of the file and returns the problems it finds:
+// pages whose checksum does not match, unsorted keys, keys outside the range
+// their parent gives them, cached nodes with a wrong parent, pages used
+// twice and pages neither used nor free. it runs in a read-only transaction, so writers wait
+// until it is done
+func (db *DB) Check() []error {
+	var problems []error
+
+	err := db.View(func(tx *Tx) error {
+		c := &checker{
+			db:   db,
+			used: make(map[uint64]string),
+		}
+
+		if _, err := db.readPageAt(0, metaOffset(db.meta.txid)); err != nil {
+			c.problem("meta: %w", err)
+		}
+
+		for _, record := range db.meta.buckets {
+			c.checkNode(record.name, record.rootpage, 0, nil, nil)
+		}
+
+		c.checkFreelist()
+		c.checkCache()
+
+		problems = c.problems
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	return problems
+}
+
+type checker struct {
+	db       *DB
+	used     map[uint64]string // page id -> bucket using it
+	problems []error
+}
+
+func (c *checker) problem(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Errorf(format, args...))
+}
+
+// checkNode checks the node stored in the page and its subtree. its keys
+// must be in [lower, upper), nil bounds are open
+func (c *checker) checkNode(bucket string, pgid uint64, parent uint64, lower []byte, upper []byte) {
+	if pgid == 0 || pgid > c.db.meta.pgid {
+		c.problem("bucket %s: page %d is out of the file, last page is %d", bucket, pgid, c.db.meta.pgid)
+		return
+	}
+
+	if other, ok := c.used[pgid]; ok {
+		c.problem("bucket %s: page %d is already used by bucket %s", bucket, pgid, other)
+		return
+	}
+	c.used[pgid] = bucket
+
+	// decode the page straight from disk so the cache cannot hide problems
+	b := &Bucket{bucket: newBucket(c.db, bucket, pgid)}
+	node, err := c.db.readNode(b, pgid)
+	if errors.Is(err, errPageNotWritten) && parent == 0 {
+		// the root of an empty bucket may never have been written
+		return
+	}
+	if errors.Is(err, errPageNotWritten) {
+		c.problem("bucket %s: page %d is referenced by page %d but was never written", bucket, pgid, parent)
+		return
+	}
+	if err != nil {
+		c.problem("bucket %s: %w", bucket, err)
+		return
+	}
+
+	for i, key := range node.Keys {
+		if i > 0 && b.compare(node.Keys[i-1], key) >= 0 {
+			c.problem("bucket %s: page %d key %q is not after key %q", bucket, pgid, key, node.Keys[i-1])
+		}
+
+		if lower != nil && b.compare(key, lower) < 0 {
+			c.problem("bucket %s: page %d key %q is before the separator %q of its parent", bucket, pgid, key, lower)
+		}
+		if upper != nil && b.compare(key, upper) >= 0 {
+			c.problem("bucket %s: page %d key %q is not before the separator %q of its parent", bucket, pgid, key, upper)
+		}
+	}
+
+	if node.typ == NODE_TYPE_LEAF {
+		if len(node.children) > 0 {
+			c.problem("bucket %s: leaf page %d has %d children", bucket, pgid, len(node.children))
+		}
+		return
+	}
+
+	if len(node.children) != len(node.Keys)+1 {
+		c.problem("bucket %s: internal page %d has %d keys but %d children", bucket, pgid, len(node.Keys), len(node.children))
+	}
+
+	for i, child := range node.children {
+		childLower, childUpper := lower, upper
+		if i > 0 && i-1 < len(node.Keys) {
+			childLower = node.Keys[i-1]
+		}
+		if i < len(node.Keys) {
+			childUpper = node.Keys[i]
+		}
+
+		c.checkNode(bucket, child, pgid, childLower, childUpper)
+	}
+}
+
+// checkCache makes sure the nodes cached in memory have the node they are
+// a child of as their parent. parents are not stored in the pages, a wrong
+// one only lives in the cache until a split or a move follows it
+func (c *checker) checkCache() {
+	c.db.mu.Lock()
+	names := make([]string, 0, len(c.db.buckets))
+	for name := range c.db.buckets {
+		names = append(names, name)
+	}
+	c.db.mu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		c.db.mu.Lock()
+		b := c.db.buckets[name]
+		c.db.mu.Unlock()
+
+		b.mu.Lock()
+		if root, ok := b.nodes[b.root]; ok && root.parent != 0 {
+			c.problem("bucket %s: root page %d has parent %d", name, root.pgid, root.parent)
+		}
+		for _, node := range b.nodes {
+			for _, pgid := range node.children {
+				if child, ok := b.nodes[pgid]; ok && child.parent != node.pgid {
+					c.problem("bucket %s: page %d has parent %d but is a child of %d", name, pgid, child.parent, node.pgid)
+				}
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// checkFreelist makes sure the freelist pages are intact, free pages are not
+// used and every page is either used or free. the pages holding the
+// freelist are not free
+func (c *checker) checkFreelist() {
+	chain := make(map[uint64]bool)
+	for pgid := c.db.meta.freelistPage; pgid != 0; {
+		if chain[pgid] {
+			c.problem("freelist: page %d is in the chain twice", pgid)
+			break
+		}
+		chain[pgid] = true
+
+		if bucket, ok := c.used[pgid]; ok {
+			c.problem("freelist: page %d is used by bucket %s", pgid, bucket)
+		}
+
+		buf, err := c.db.readPage(pgid)
+		if err != nil {
+			c.problem("freelist: %w", err)
+			break
+		}
+		if buf[8] != PAGE_TYPE_FREELIST {
+			c.problem("freelist: page %d is not a freelist page", pgid)
+			break
+		}
+
+		pgid = binary.LittleEndian.Uint64(buf[13:21])
+	}
+
+	free := make(map[uint64]bool)
+	for _, pgid := range c.db.meta.freelist {
+		if free[pgid] {
+			c.problem("page %d is in the freelist twice", pgid)
+		}
+		free[pgid] = true
+
+		if chain[pgid] {
+			c.problem("page %d is free but holds the freelist", pgid)
+		}
+
+		if pgid == 0 || pgid > c.db.meta.pgid {
+			c.problem("free page %d is out of the file, last page is %d", pgid, c.db.meta.pgid)
+		}
+
+		if bucket, ok := c.used[pgid]; ok {
+			c.problem("page %d is free but used by bucket %s", pgid, bucket)
+		}
+	}
+
+	for pgid := uint64(1); pgid <= c.db.meta.pgid; pgid++ {
+		if _, ok := c.used[pgid]; !ok && !free[pgid] && !chain[pgid] {
+			c.problem("page %d is neither used nor free", pgid)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package kvdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDBCheck(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "numbers")
+	for i := 0; i < 300; i++ {
+		err = bucket.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := bucket.DeleteRange([]byte("050"), []byte("250")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := bucket.Delete([]byte(fmt.Sprintf("%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mustBucket(t, db, "sessions").PutWithTTL([]byte("session"), []byte("x"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := db.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems but got %v", problems)
+	}
+}
+
+func TestDBCheckFindsProblems(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "numbers")
+	for i := 0; i < 20; i++ {
+		err = bucket.Put([]byte(fmt.Sprintf("%02d", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var leaf *Node
+	err = db.Update(func(tx *Tx) error {
+		b := tx.Bucket("numbers")
+		root := b.node(b.root)
+		leaf = root.child(root.children[0])
+		for leaf.typ != NODE_TYPE_LEAF {
+			leaf = leaf.child(leaf.children[0])
+		}
+
+		// unsorted keys
+		leaf.Keys = append(leaf.Keys, []byte("00"))
+		leaf.values = append(leaf.values, []byte("0"))
+		leaf.dirty = true
+
+		// the same page used twice
+		root.children[len(root.children)-1] = root.children[0]
+		root.dirty = true
+
+		// a page nobody uses
+		db.meta.pgid++
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a wrong parent pointer, set after the commit since the commit follows
+	// the parents of the nodes it moves
+	leaf.parent = leaf.parent + 100
+
+	problems := db.Check()
+
+	expected := []string{
+		"is not after key",
+		"has parent",
+		"is already used by bucket numbers",
+		"is neither used nor free",
+	}
+	for _, text := range expected {
+		found := false
+		for _, problem := range problems {
+			if strings.Contains(problem.Error(), text) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("expected a problem containing %q but got %v", text, problems)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// kvdb-server serves a kvdb database file to Redis clients, see package resp
+// for the supported commands, and over HTTP with --http, see package httpapi.
+// it stops on SIGINT or SIGTERM
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"ahmedash95/kvdb"
+	"ahmedash95/kvdb/httpapi"
+	"ahmedash95/kvdb/resp"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:6379", "address to listen on")
+	httpAddr := flag.String("http", "", "address to serve the HTTP API on, none by default")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: kvdb-server [--addr host:port] [--http host:port] <file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db, err := kvdb.Open(flag.Arg(0), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		db.Close()
+		log.Fatal(err)
+	}
+
+	server := resp.NewServer(db)
+
+	var httpServer *http.Server
+	if *httpAddr != "" {
+		httpServer = &http.Server{Addr: *httpAddr, Handler: httpapi.Handler(db)}
+		go func() {
+			log.Printf("serving the HTTP API on %s", *httpAddr)
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Print(err)
+				server.Close()
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+
+	log.Printf("serving %s on %s", flag.Arg(0), l.Addr())
+	if err := server.Serve(l); err != resp.ErrServerClosed {
+		log.Print(err)
+	}
+	if httpServer != nil {
+		httpServer.Close()
+	}
+
+	if err := db.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,360 @@
+// kvdb is a command line tool to look inside and edit kvdb database files.
+// the database must not be open by another process
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"ahmedash95/kvdb"
+)
+
+type command struct {
+	usage string
+	run   func(w io.Writer, args []string) error
+}
+
+var commands = map[string]command{
+	"buckets": {"<file>", buckets},
+	"keys":    {"<file> <bucket>", keys},
+	"get":     {"<file> <bucket> <key>", get},
+	"put":     {"<file> <bucket> <key> <value>", put},
+	"delete":  {"<file> <bucket> <key>", del},
+	"scan":    {"[--prefix p] [--start s] [--end e] <file> <bucket>", scan},
+	"stats":   {"<file>", stats},
+	"check":   {"<file>", check},
+	"pages":   {"<file>", pages},
+	"page":    {"[--hex] <file> <id>", page},
+	"dump":    {"<file>", dump},
+	"compact": {"[--tx-max-size bytes] <src> <dst>", compact},
+	"shell":   {"<file>", shellCmd},
+}
+
+// errUsage makes main print the usage of the command
+var errUsage = errors.New("usage")
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Stdout, os.Args[2:]); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: kvdb %s %s\n", name, cmd.usage)
+			os.Exit(2)
+		}
+
+		fmt.Fprintf(os.Stderr, "kvdb %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: kvdb <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+}
+
+// open opens an existing database file. the expiry sweeper is disabled so
+// looking at a file never changes it
+func open(path string) (*kvdb.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return kvdb.Open(path, &kvdb.Config{TTLSweepInterval: -1})
+}
+
+// view opens the file and runs fn with the named bucket in a read-only
+// transaction
+func view(path string, name string, fn func(b *kvdb.Bucket) error) error {
+	db, err := open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *kvdb.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", name)
+		}
+
+		return fn(b)
+	})
+}
+
+func buckets(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	db, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, name := range db.Buckets() {
+		fmt.Fprintln(w, name)
+	}
+
+	return nil
+}
+
+func keys(w io.Writer, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+
+	return view(args[0], args[1], func(b *kvdb.Bucket) error {
+		return b.Scan(func(key, value []byte) bool {
+			fmt.Fprintln(w, format(key))
+			return true
+		})
+	})
+}
+
+func get(w io.Writer, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+
+	return view(args[0], args[1], func(b *kvdb.Bucket) error {
+		value, err := b.Get([]byte(args[2]))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, format(value))
+		return nil
+	})
+}
+
+func put(w io.Writer, args []string) error {
+	if len(args) != 4 {
+		return errUsage
+	}
+
+	db, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *kvdb.Tx) error {
+		return tx.Bucket(args[1]).Put([]byte(args[2]), []byte(args[3]))
+	})
+}
+
+func del(w io.Writer, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+
+	db, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// do not create the bucket just to find out the key is not there
+	found := false
+	for _, name := range db.Buckets() {
+		found = found || name == args[1]
+	}
+	if !found {
+		return fmt.Errorf("bucket %s not found", args[1])
+	}
+
+	return db.Update(func(tx *kvdb.Tx) error {
+		return tx.Bucket(args[1]).Delete([]byte(args[2]))
+	})
+}
+
+func scan(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	prefix := flags.String("prefix", "", "only keys starting with the prefix")
+	start := flags.String("start", "", "first key of the range")
+	end := flags.String("end", "", "key the range stops before")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+
+	if *prefix != "" && (*start != "" || *end != "") {
+		return fmt.Errorf("--prefix cannot be used with --start or --end")
+	}
+
+	return view(flags.Arg(0), flags.Arg(1), func(b *kvdb.Bucket) error {
+		print := func(key, value []byte) bool {
+			fmt.Fprintf(w, "%s\t%s\n", format(key), format(value))
+			return true
+		}
+
+		if *prefix != "" {
+			return b.ScanPrefix([]byte(*prefix), print)
+		}
+
+		return b.ScanRange([]byte(*start), []byte(*end), print)
+	})
+}
+
+func stats(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	db, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.Stats()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "file size\t%d\n", stats.FileSize)
+	fmt.Fprintf(tw, "pages\t%d\n", stats.PageN)
+	fmt.Fprintf(tw, "free pages\t%d\n", stats.FreePageN)
+
+	for _, name := range db.Buckets() {
+		handle, err := db.Bucket(name)
+		if err != nil {
+			return err
+		}
+
+		bucket, err := handle.Stats()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(tw, "bucket %s\n", format([]byte(name)))
+		fmt.Fprintf(tw, "  keys\t%d\n", bucket.KeyN)
+		fmt.Fprintf(tw, "  depth\t%d\n", bucket.Depth)
+		fmt.Fprintf(tw, "  leaf pages\t%d\n", bucket.LeafPageN)
+		fmt.Fprintf(tw, "  internal pages\t%d\n", bucket.InternalPageN)
+		fmt.Fprintf(tw, "  bytes used\t%d of %d\n", bucket.LeafInuse+bucket.InternalInuse, bucket.Allocated)
+		fmt.Fprintf(tw, "  fill\t%.1f%%\n", bucket.Fill*100)
+	}
+
+	return tw.Flush()
+}
+
+func check(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	db, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	problems := db.Check()
+	for _, problem := range problems {
+		fmt.Fprintln(w, problem)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+
+	fmt.Fprintln(w, "ok")
+	return nil
+}
+
+func dump(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	db, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	names := db.Buckets()
+	return db.View(func(tx *kvdb.Tx) error {
+		for _, name := range names {
+			fmt.Fprintf(w, "bucket %s\n", name)
+			err := tx.Bucket(name).Scan(func(key, value []byte) bool {
+				fmt.Fprintf(w, "\t%s\t%s\n", format(key), format(value))
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func compact(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	txMaxSize := flags.Int64("tx-max-size", 64<<20, "bytes of keys and values copied before the complete nodes are written, 0 keeps all in memory")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+
+	if _, err := os.Stat(flags.Arg(1)); err == nil {
+		return fmt.Errorf("%s already exists", flags.Arg(1))
+	}
+
+	src, err := open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := kvdb.Open(flags.Arg(1), &kvdb.Config{TTLSweepInterval: -1})
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err := kvdb.Compact(dst, src, *txMaxSize); err != nil {
+		return err
+	}
+
+	srcInfo, err := os.Stat(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	dstInfo, err := os.Stat(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d -> %d bytes\n", srcInfo.Size(), dstInfo.Size())
+
+	return nil
+}
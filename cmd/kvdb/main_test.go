@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"ahmedash95/kvdb"
+)
+
+// kvdbCmd runs the named command and returns what it printed
+func kvdbCmd(args ...string) (string, error) {
+	var out bytes.Buffer
+	err := commands[args[0]].run(&out, args[1:])
+	return out.String(), err
+}
+
+// mustBucket returns a handle of the named bucket, creating it
+func mustBucket(t *testing.T, db *kvdb.DB, name string) *kvdb.Bucket {
+	t.Helper()
+
+	bucket, err := db.Bucket(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bucket
+}
+
+func TestCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := kvdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		err = mustBucket(t, db, "users").Put([]byte(fmt.Sprintf("user:%02d", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mustBucket(t, db, "binary").Put([]byte{0x00, 0xff}, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"buckets", path}, "users\nbinary\n"},
+		{[]string{"get", path, "users", "user:05"}, "5\n"},
+		{[]string{"put", path, "users", "user:05", "five"}, ""},
+		{[]string{"get", path, "users", "user:05"}, "five\n"},
+		{[]string{"delete", path, "users", "user:00"}, ""},
+		{[]string{"scan", "--prefix", "user:1", path, "users"}, "user:10\t10\nuser:11\t11\nuser:12\t12\nuser:13\t13\nuser:14\t14\nuser:15\t15\nuser:16\t16\nuser:17\t17\nuser:18\t18\nuser:19\t19\n"},
+		{[]string{"scan", "--start", "user:04", "--end", "user:06", path, "users"}, "user:04\t4\nuser:05\tfive\n"},
+		{[]string{"keys", path, "binary"}, "0x00ff\n"},
+		{[]string{"check", path}, "ok\n"},
+	}
+
+	for _, test := range tests {
+		out, err := kvdbCmd(test.args...)
+		if err != nil {
+			t.Fatalf("%v: %v", test.args, err)
+		}
+
+		if out != test.expected {
+			t.Fatalf("%v: expected %q but got %q", test.args, test.expected, out)
+		}
+	}
+
+	if _, err := kvdbCmd("get", path, "users", "user:00"); err == nil {
+		t.Fatal("expected deleted key to be missing")
+	}
+	if _, err := kvdbCmd("get", path, "missing", "key"); err == nil || !strings.Contains(err.Error(), "bucket missing not found") {
+		t.Fatalf("expected bucket not found but got %v", err)
+	}
+	if _, err := kvdbCmd("get", path); err != errUsage {
+		t.Fatalf("expected usage error but got %v", err)
+	}
+
+	out, err := kvdbCmd("dump", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "bucket users\n\tuser:01\t1\n") || !strings.Contains(out, "bucket binary\n\t0x00ff\tx\n") {
+		t.Fatalf("unexpected dump %q", out)
+	}
+
+	out, err = kvdbCmd("pages", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`\n0\s+meta`).MatchString(out) || !regexp.MustCompile(`leaf\s+users`).MatchString(out) {
+		t.Fatalf("unexpected pages %q", out)
+	}
+
+	out, err = kvdbCmd("page", "--hex", path, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "type\tmeta\nfree\tfalse\nbuckets\t2\n") || !strings.Contains(out, "00000000  00 00 00 00 00 00 00 00  04") {
+		t.Fatalf("unexpected page %q", out)
+	}
+
+	out, err = kvdbCmd("stats", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`bucket users\n\s+keys\s+19\n`).MatchString(out) {
+		t.Fatalf("unexpected stats %q", out)
+	}
+
+	compacted := filepath.Join(t.TempDir(), "compacted.db")
+	if _, err := kvdbCmd("compact", path, compacted); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := kvdbCmd("get", compacted, "users", "user:05"); err != nil || out != "five\n" {
+		t.Fatalf("expected five in the compacted file but got %q, %v", out, err)
+	}
+	if _, err := kvdbCmd("compact", path, compacted); err == nil {
+		t.Fatal("expected compact to refuse an existing destination")
+	}
+}
+
+func TestPagesOfBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := kvdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := mustBucket(t, db, "users").Put([]byte(fmt.Sprintf("user:%02d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// break the checksum of both copies of the meta page so the file
+	// cannot be opened
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{100, kvdb.META_PAGE_SIZE + 100} {
+		if _, err := file.WriteAt([]byte{0xff}, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	if _, err := kvdbCmd("buckets", path); err == nil {
+		t.Fatal("expected the broken file not to open")
+	}
+
+	out, err := kvdbCmd("pages", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "cannot open the file") || !regexp.MustCompile(`\n0\s+meta`).MatchString(out) || !regexp.MustCompile(`\n\d+\s+leaf`).MatchString(out) {
+		t.Fatalf("unexpected pages %q", out)
+	}
+}
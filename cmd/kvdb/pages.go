@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+
+	"ahmedash95/kvdb"
+)
+
+// format returns b as text when it is printable, otherwise as hex
+func format(b []byte) string {
+	if !utf8.Valid(b) {
+		return "0x" + hex.EncodeToString(b)
+	}
+
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return "0x" + hex.EncodeToString(b)
+		}
+	}
+
+	return string(b)
+}
+
+// pages lists every page with its type and how much of it is used. files
+// the database cannot open are read page by page, so broken files can
+// still be looked at
+func pages(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	var pages []*kvdb.PageInfo
+	db, err := open(args[0])
+	if err != nil {
+		var readErr error
+		if pages, readErr = kvdb.ReadPages(args[0]); readErr != nil {
+			return err
+		}
+		fmt.Fprintf(w, "cannot open the file, pages are read without the meta page: %v\n", err)
+	} else {
+		defer db.Close()
+
+		if pages, err = db.Pages(); err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTYPE\tBUCKET\tKEYS\tUSED\tNOTE")
+	for _, page := range pages {
+		note := ""
+		if page.Free {
+			note = "free"
+		}
+		if page.Err != nil {
+			note = page.Err.Error()
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d%%\t%s\n", page.ID, page.Type, format([]byte(page.Bucket)), page.Keys, page.Used*100/page.Size, note)
+	}
+
+	return tw.Flush()
+}
+
+// page prints the decoded page and optionally its raw bytes
+func page(w io.Writer, args []string) error {
+	flags := flag.NewFlagSet("page", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	raw := flags.Bool("hex", false, "print the raw bytes of the page")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+
+	pgid, err := strconv.ParseUint(flags.Arg(1), 10, 64)
+	if err != nil {
+		return errUsage
+	}
+
+	db, err := open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	page, err := db.Page(pgid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "id\t%d\n", page.ID)
+	fmt.Fprintf(w, "type\t%s\n", page.Type)
+	if page.Bucket != "" {
+		fmt.Fprintf(w, "bucket\t%s\n", format([]byte(page.Bucket)))
+	}
+	fmt.Fprintf(w, "free\t%t\n", page.Free)
+	switch page.Type {
+	case "internal", "leaf":
+		fmt.Fprintf(w, "parent\t%d\n", page.Parent)
+		fmt.Fprintf(w, "keys\t%d\n", page.Keys)
+		fmt.Fprintf(w, "children\t%v\n", page.Children)
+	case "freelist":
+		fmt.Fprintf(w, "ids\t%d\n", page.Keys)
+		fmt.Fprintf(w, "next\t%d\n", page.Next)
+	case "meta":
+		fmt.Fprintf(w, "buckets\t%d\n", page.Keys)
+	}
+	fmt.Fprintf(w, "used\t%d of %d bytes\n", page.Used, page.Size)
+	if page.Err != nil {
+		fmt.Fprintf(w, "error\t%v\n", page.Err)
+	}
+
+	if *raw {
+		fmt.Fprint(w, hex.Dump(page.Data))
+	}
+
+	return nil
+}
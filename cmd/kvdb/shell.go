@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"ahmedash95/kvdb"
+)
+
+// stdin is where the shell reads commands from
+var stdin io.Reader = os.Stdin
+
+const shellHelp = `commands:
+  use <bucket>              pick the bucket the other commands work on
+  buckets                   list buckets
+  get <key>                 print the value of key
+  put <key> <value>         set key to value
+  del <key>                 delete key
+  scan [prefix]             print every key, or the keys starting with prefix
+  begin                     start a transaction, changes are kept until commit
+  commit                    commit the transaction
+  rollback                  drop the changes of the transaction
+  format <utf8|hex|json>    how keys and values are printed
+  help                      print this help
+  exit                      leave the shell, rolling back an open transaction
+arguments with spaces or binary bytes can be written as Go quoted strings,
+like "a key" or "\x00\xff"`
+
+// shell is an interactive session on a database file
+type shell struct {
+	db     *kvdb.DB
+	w      io.Writer
+	bucket string
+	tx     *kvdb.Tx // transaction started with begin, nil outside of one
+	format string
+}
+
+var errNoBucket = errors.New("no bucket selected, run use <bucket> first")
+
+func shellCmd(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	db, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sh := &shell{db: db, w: w, format: "utf8"}
+	defer sh.close()
+
+	scanner := bufio.NewScanner(stdin)
+	for {
+		sh.prompt()
+		if !scanner.Scan() {
+			fmt.Fprintln(w)
+			return scanner.Err()
+		}
+
+		args, err := splitArgs(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+
+		if err := sh.run(args); err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+		}
+	}
+}
+
+func (sh *shell) prompt() {
+	prompt := sh.bucket
+	if sh.tx != nil {
+		prompt += "*"
+	}
+
+	fmt.Fprintf(sh.w, "%s> ", prompt)
+}
+
+// close rolls back a transaction left open
+func (sh *shell) close() {
+	if sh.tx != nil {
+		sh.tx.Rollback()
+		fmt.Fprintln(sh.w, "transaction rolled back")
+	}
+}
+
+func (sh *shell) run(args []string) error {
+	switch {
+	case args[0] == "help":
+		fmt.Fprintln(sh.w, shellHelp)
+		return nil
+
+	case args[0] == "use" && len(args) == 2:
+		sh.bucket = args[1]
+		return nil
+
+	case args[0] == "buckets" && len(args) == 1:
+		return sh.view(func(tx *kvdb.Tx) error {
+			for _, name := range tx.Buckets() {
+				fmt.Fprintln(sh.w, name)
+			}
+			return nil
+		})
+
+	case args[0] == "format" && len(args) == 2:
+		switch args[1] {
+		case "utf8", "hex", "json":
+			sh.format = args[1]
+			return nil
+		}
+		return fmt.Errorf("unknown format %s", args[1])
+
+	case args[0] == "begin" && len(args) == 1:
+		if sh.tx != nil {
+			return fmt.Errorf("a transaction is already open")
+		}
+
+		tx, err := sh.db.Begin(true)
+		if err != nil {
+			return err
+		}
+
+		sh.tx = tx
+		return nil
+
+	case (args[0] == "commit" || args[0] == "rollback") && len(args) == 1:
+		if sh.tx == nil {
+			return fmt.Errorf("no transaction is open")
+		}
+
+		tx := sh.tx
+		sh.tx = nil
+		if args[0] == "commit" {
+			return tx.Commit()
+		}
+		return tx.Rollback()
+
+	case args[0] == "get" && len(args) == 2:
+		return sh.view(func(tx *kvdb.Tx) error {
+			b, err := sh.open(tx, false)
+			if err != nil {
+				return err
+			}
+
+			value, err := b.Get([]byte(args[1]))
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintln(sh.w, sh.print(value))
+			return nil
+		})
+
+	case args[0] == "put" && len(args) == 3:
+		return sh.update(func(tx *kvdb.Tx) error {
+			b, err := sh.open(tx, true)
+			if err != nil {
+				return err
+			}
+
+			return b.Put([]byte(args[1]), []byte(args[2]))
+		})
+
+	case args[0] == "del" && len(args) == 2:
+		return sh.update(func(tx *kvdb.Tx) error {
+			b, err := sh.open(tx, false)
+			if err != nil {
+				return err
+			}
+
+			return b.Delete([]byte(args[1]))
+		})
+
+	case args[0] == "scan" && len(args) <= 2:
+		return sh.view(func(tx *kvdb.Tx) error {
+			b, err := sh.open(tx, false)
+			if err != nil {
+				return err
+			}
+
+			print := func(key, value []byte) bool {
+				fmt.Fprintf(sh.w, "%s\t%s\n", sh.print(key), sh.print(value))
+				return true
+			}
+
+			if len(args) == 2 {
+				return b.ScanPrefix([]byte(args[1]), print)
+			}
+			return b.Scan(print)
+		})
+	}
+
+	return fmt.Errorf("unknown command %q, run help to list commands", strings.Join(args, " "))
+}
+
+// view runs fn in the open transaction or in a read-only one
+func (sh *shell) view(fn func(tx *kvdb.Tx) error) error {
+	if sh.tx != nil {
+		return fn(sh.tx)
+	}
+
+	return sh.db.View(fn)
+}
+
+// update runs fn in the open transaction or in a writable one of its own
+func (sh *shell) update(fn func(tx *kvdb.Tx) error) error {
+	if sh.tx != nil {
+		return fn(sh.tx)
+	}
+
+	return sh.db.Update(fn)
+}
+
+// open returns the selected bucket, creating it only when create is true
+func (sh *shell) open(tx *kvdb.Tx, create bool) (*kvdb.Bucket, error) {
+	if sh.bucket == "" {
+		return nil, errNoBucket
+	}
+
+	if !create {
+		found := false
+		for _, name := range tx.Buckets() {
+			found = found || name == sh.bucket
+		}
+		if !found {
+			return nil, fmt.Errorf("bucket %s not found", sh.bucket)
+		}
+	}
+
+	return tx.Bucket(sh.bucket), nil
+}
+
+// print formats b with the format picked with the format command
+func (sh *shell) print(b []byte) string {
+	switch sh.format {
+	case "hex":
+		return hex.EncodeToString(b)
+	case "json":
+		if json.Valid(b) {
+			return string(b)
+		}
+
+		out, _ := json.Marshal(string(b))
+		return string(out)
+	}
+
+	return string(b)
+}
+
+// splitArgs splits a line on spaces. arguments may be Go quoted strings
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		prefix, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("unterminated quoted argument %s", line)
+		}
+
+		arg, err := strconv.Unquote(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+		line = line[len(prefix):]
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ahmedash95/kvdb"
+)
+
+func TestShell(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := kvdb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, db, "users").Put([]byte("Ahmed"), []byte("ahmed@email.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin = strings.NewReader(strings.Join([]string{
+		"get Ahmed",
+		"use users",
+		"get Ahmed",
+		`put "Basem Ali" basem@email.com`,
+		"begin",
+		"put Camal camal@email.com",
+		"del Ahmed",
+		"scan",
+		"rollback",
+		"format hex",
+		"get Ahmed",
+		"format json",
+		`put Dawood {"age":30}`,
+		"scan D",
+		"use missing",
+		"get Ahmed",
+		"begin",
+		"use users",
+		"put Emad emad@email.com",
+	}, "\n"))
+	defer func() { stdin = os.Stdin }()
+
+	out, err := kvdbCmd("shell", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"> error: no bucket selected, run use <bucket> first",
+		"users> ahmed@email.com",
+		// inside the transaction
+		"users*> users*> users*> Basem Ali\tbasem@email.com\nCamal\tcamal@email.com\n",
+		"users> 61686d656440656d61696c2e636f6d",
+		`users> "Dawood"` + "\t" + `{"age":30}`,
+		"missing> error: bucket missing not found",
+		"transaction rolled back",
+	}
+	for _, text := range expected {
+		if !strings.Contains(out, text) {
+			t.Fatalf("expected the output to contain %q but got\n%s", text, out)
+		}
+	}
+
+	// the rolled back changes are not in the file
+	out, err = kvdbCmd("dump", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out != "bucket users\n\tAhmed\tahmed@email.com\n\tBasem Ali\tbasem@email.com\n\tDawood\t{\"age\":30}\n" {
+		t.Fatalf("unexpected dump %q", out)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(`put  "a key" "\x00\xff" plain`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(args) != 4 || args[1] != "a key" || args[2] != "\x00\xff" || args[3] != "plain" {
+		t.Fatalf("unexpected args %q", args)
+	}
+
+	if _, err := splitArgs(`get "open`); err == nil {
+		t.Fatal("expected an unterminated quote to fail")
+	}
+}
@@ -0,0 +1,231 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Codec turns values of type T into bytes and back. codecs used for the
+// keys of a TypedBucket must keep the order, encoded keys must compare with
+// bytes.Compare like the values compare. IntKey, UintKey, StringKey,
+// BytesKey, TimeKey, PairKey and tuple.Codec do
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob. every value carries its type
+// description, so it suits few large values better than many small ones
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// BinaryCodec encodes fixed-size values, like numbers, arrays and structs of
+// them, with encoding/binary in big endian
+type BinaryCodec[T any] struct{}
+
+func (BinaryCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, v)
+	return buf.Bytes(), err
+}
+
+func (BinaryCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	size := binary.Size(v)
+	if size < 0 {
+		return v, fmt.Errorf("binary codec: %T is not fixed-size", v)
+	}
+	if size != len(data) {
+		return v, fmt.Errorf("binary codec: expected %d bytes but got %d", size, len(data))
+	}
+
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &v)
+	return v, err
+}
+
+type signed interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64
+}
+
+type unsigned interface {
+	~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// IntKey encodes signed integers in 8 bytes big endian with the sign bit
+// flipped, so negative numbers sort before positive ones
+type IntKey[T signed] struct{}
+
+func (IntKey[T]) Encode(v T) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^(1<<63)), nil
+}
+
+func (IntKey[T]) Decode(data []byte) (T, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("int key: expected 8 bytes but got %d", len(data))
+	}
+
+	return T(int64(binary.BigEndian.Uint64(data) ^ (1 << 63))), nil
+}
+
+// UintKey encodes unsigned integers in 8 bytes big endian
+type UintKey[T unsigned] struct{}
+
+func (UintKey[T]) Encode(v T) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)), nil
+}
+
+func (UintKey[T]) Decode(data []byte) (T, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("uint key: expected 8 bytes but got %d", len(data))
+	}
+
+	return T(binary.BigEndian.Uint64(data)), nil
+}
+
+// StringKey stores strings as they are, UTF-8 sorts in code point order
+type StringKey struct{}
+
+func (StringKey) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringKey) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// BytesKey stores byte slices as they are
+type BytesKey struct{}
+
+func (BytesKey) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (BytesKey) Decode(data []byte) ([]byte, error) {
+	return append([]byte{}, data...), nil
+}
+
+// TimeKey encodes times as their unix time in nanoseconds like IntKey, so
+// it keeps the order of times between the years 1678 and 2262. decoded times
+// are in UTC
+type TimeKey struct{}
+
+func (TimeKey) Encode(v time.Time) ([]byte, error) {
+	return IntKey[int64]{}.Encode(v.UnixNano())
+}
+
+func (TimeKey) Decode(data []byte) (time.Time, error) {
+	n, err := IntKey[int64]{}.Decode(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, n).UTC(), nil
+}
+
+// Pair is a key made of two values, ordered by First and then by Second
+type Pair[A, B any] struct {
+	First  A
+	Second B
+}
+
+// PairKey encodes a Pair with the codecs of its values. the first value is
+// escaped and terminated so a shorter first value sorts before a longer one
+// it is a prefix of, whatever the second value is
+//
+//	first with every 0x00 written as 0x00 0xff, 0x00 0x01, second
+type PairKey[A, B any] struct {
+	First  Codec[A]
+	Second Codec[B]
+}
+
+func (c PairKey[A, B]) Encode(v Pair[A, B]) ([]byte, error) {
+	first, err := c.First.Encode(v.First)
+	if err != nil {
+		return nil, err
+	}
+
+	second, err := c.Second.Encode(v.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(first)+len(second)+2)
+	for _, b := range first {
+		buf = append(buf, b)
+		if b == 0x00 {
+			buf = append(buf, 0xff)
+		}
+	}
+	buf = append(buf, 0x00, 0x01)
+
+	return append(buf, second...), nil
+}
+
+func (c PairKey[A, B]) Decode(data []byte) (Pair[A, B], error) {
+	var pair Pair[A, B]
+
+	var first []byte
+	i := 0
+	for ; i < len(data); i++ {
+		if data[i] != 0x00 {
+			first = append(first, data[i])
+			continue
+		}
+
+		if i+1 == len(data) {
+			break
+		}
+
+		// an escaped 0x00 or the end of the first value
+		if data[i+1] == 0xff {
+			first = append(first, 0x00)
+			i++
+			continue
+		}
+		if data[i+1] == 0x01 {
+			break
+		}
+		return pair, fmt.Errorf("pair key: invalid escape 0x00 0x%02x", data[i+1])
+	}
+	if i+1 >= len(data) {
+		return pair, fmt.Errorf("pair key: the first value is not terminated")
+	}
+
+	var err error
+	if pair.First, err = c.First.Decode(first); err != nil {
+		return pair, err
+	}
+	if pair.Second, err = c.Second.Decode(data[i+2:]); err != nil {
+		return pair, err
+	}
+
+	return pair, nil
+}
@@ -0,0 +1,147 @@
+package kvdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Compact copies every bucket of src into dst, which should be a new
+// database. the keys are inserted in order so dst is written with nodes
+// filling their pages and no free pages. the copy is committed once, but
+// every txMaxSize bytes of keys and values the nodes that are complete are
+// written and dropped from memory, zero keeps every node in memory until the
+// commit.
+//
+// the keys of the user buckets and of their expiries are copied. the change
+// log is not, only its sequence, so ChangesSince on dst reports the changes
+// made before the copy as truncated. indexes are not copied either, they are
+// built again by CreateIndex after dst is opened
+func Compact(dst *DB, src *DB, txMaxSize int64) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	// the copy is not a change, it is not logged or sent to watchers
+	tx.recording = false
+
+	defer func() {
+		if !tx.done {
+			tx.Rollback()
+		}
+	}()
+
+	var size int64
+	err = src.View(func(srcTx *Tx) (err error) {
+		defer recoverReadError(&err)
+
+		for _, record := range src.meta.buckets {
+			if strings.HasPrefix(record.name, indexBucketPrefix) {
+				continue
+			}
+
+			srcBucket := srcTx.bucket(record.name, false)
+
+			// the copy keeps the order of the keys
+			dst.mu.Lock()
+			comparator, ok := dst.comparators[record.name]
+			if !ok && dst.meta.record(record.name) == nil {
+				comparator = srcBucket.comparator
+				dst.comparators[record.name] = comparator
+			}
+			dst.mu.Unlock()
+			if comparator.Name != record.comparator {
+				return fmt.Errorf("bucket %s uses comparator %q but %q in the destination", record.name, record.comparator, comparator.Name)
+			}
+
+			b := tx.bucket(record.name, true)
+			dst.meta.record(record.name).sequence = record.sequence
+			if record.name == changeLogBucketName {
+				continue
+			}
+
+			b.sequential = true
+			srcBucket.node(srcBucket.root).scan(func(key []byte, value []byte) bool {
+				if txMaxSize > 0 && size > 0 && size+int64(len(key)+len(value)) > txMaxSize {
+					if err = compactFlush(tx); err != nil {
+						return false
+					}
+					size = 0
+				}
+
+				b.put(append([]byte{}, key...), append([]byte{}, value...))
+				size += int64(len(key) + len(value))
+
+				return true
+			})
+			b.sequential = false
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return compactCommit(tx)
+}
+
+// compactFlush writes the nodes of the copy that are complete and drops
+// them from the cache, so the memory Compact uses is bounded by txMaxSize.
+// keys are inserted in order, so only the nodes on the right edge of a tree
+// change again. the pages were allocated by tx, the file does not use them
+// before it commits
+func compactFlush(tx *Tx) error {
+	for _, b := range tx.buckets {
+		edge := make(map[uint64]bool)
+		for pgid := b.root; ; {
+			node, ok := b.nodes[pgid]
+			if !ok {
+				break
+			}
+			edge[pgid] = true
+			if node.typ == NODE_TYPE_LEAF || len(node.children) == 0 {
+				break
+			}
+			pgid = node.children[len(node.children)-1]
+		}
+
+		b.mu.Lock()
+		for pgid, node := range b.nodes {
+			// nodes on pages the file uses are moved by the commit
+			if edge[pgid] || (node.dirty && !tx.db.meta.isAllocated(pgid)) {
+				continue
+			}
+
+			if node.dirty {
+				if err := tx.db.writeNode(node); err != nil {
+					b.mu.Unlock()
+					return err
+				}
+			}
+			delete(b.nodes, pgid)
+		}
+		b.mu.Unlock()
+	}
+
+	return nil
+}
+
+// compactCommit commits the copy and drops the nodes it wrote from the cache
+func compactCommit(tx *Tx) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, b := range tx.buckets {
+		b.mu.Lock()
+		b.nodes = make(map[uint64]*Node)
+		b.mu.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	src, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer src.Close()
+
+	bucket := mustBucket(t, src, "numbers")
+	err = src.Update(func(tx *Tx) error {
+		for _, i := range rand.New(rand.NewSource(1)).Perm(1000) {
+			if err := tx.Bucket("numbers").Put([]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("%0100d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.DeleteRange([]byte("0100"), []byte("0900")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.SetSequence(42); err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, src, "sessions").PutWithTTL([]byte("session"), []byte("x"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	mustBucket(t, src, "empty")
+
+	dstPath := tempDBPath(t) + ".compact"
+	dst, err := Open(dstPath, &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dst.Close()
+
+	if err := Compact(dst, src, 256); err != nil {
+		t.Fatal(err)
+	}
+
+	if problems := dst.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems but got %v", problems)
+	}
+
+	for _, name := range []string{"numbers", "sessions", "empty"} {
+		expected := []string{}
+		mustBucket(t, src, name).Scan(func(key, value []byte) bool {
+			expected = append(expected, fmt.Sprintf("%s=%s", key, value))
+			return true
+		})
+
+		keys := []string{}
+		mustBucket(t, dst, name).Scan(func(key, value []byte) bool {
+			keys = append(keys, fmt.Sprintf("%s=%s", key, value))
+			return true
+		})
+
+		if fmt.Sprint(keys) != fmt.Sprint(expected) {
+			t.Fatalf("bucket %s: expected %v but got %v", name, expected, keys)
+		}
+	}
+
+	sequence, err := mustBucket(t, dst, "numbers").Sequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != 42 {
+		t.Fatalf("expected sequence 42 but got %d", sequence)
+	}
+
+	if _, err := mustBucket(t, dst, "sessions").Get([]byte("session")); err != nil {
+		t.Fatalf("expected the expiry index to be copied: %v", err)
+	}
+
+	srcInfo, err := os.Stat(src.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstInfo, err := os.Stat(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dstInfo.Size()*2 > srcInfo.Size() {
+		t.Fatalf("expected the compacted file to be less than half of %d bytes but got %d", srcInfo.Size(), dstInfo.Size())
+	}
+	if len(dst.meta.freelist) != 0 || len(dst.meta.chain) != 0 {
+		t.Fatalf("expected no free pages but got %v and the freelist chain %v", dst.meta.freelist, dst.meta.chain)
+	}
+
+	// every leaf but the last one is nearly full
+	stats, err := mustBucket(t, dst, "numbers").Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LeafPageN < 2 || stats.LeafPageN > stats.LeafInuse*10/(PAGE_SIZE*9)+1 {
+		t.Fatalf("expected leaves at least 90%% full but got %d leaves using %d bytes", stats.LeafPageN, stats.LeafInuse)
+	}
+
+	// the compacted database keeps working
+	if err := mustBucket(t, dst, "numbers").Put([]byte("0500"), []byte("500")); err != nil {
+		t.Fatal(err)
+	}
+	if problems := dst.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems after a put but got %v", problems)
+	}
+}
+
+func TestCompactInternalBuckets(t *testing.T) {
+	src, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 3, ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer src.Close()
+
+	accounts := mustBucket(t, src, "accounts")
+	for i := 0; i < 50; i++ {
+		if err := accounts.Put([]byte(fmt.Sprintf("%02d", i)), []byte(fmt.Sprintf("user%d", i%5))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := accounts.CreateIndex("user", func(value []byte) [][]byte { return [][]byte{value} }); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open(tempDBPath(t)+".compact", &Config{maxKeysPerNode: 3, ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dst.Close()
+
+	if err := Compact(dst, src, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	// the nodes written by every chunk were dropped from the cache
+	for name, b := range dst.buckets {
+		if len(b.nodes) > 0 {
+			t.Fatalf("bucket %q: expected no cached nodes but got %d", name, len(b.nodes))
+		}
+	}
+
+	// the change log keeps its sequence but not the changes
+	err = dst.ChangesSince(0, func(Event) bool { return true })
+	if !errors.Is(err, ErrChangesTruncated) {
+		t.Fatalf("expected ErrChangesTruncated but got %v", err)
+	}
+	if err := mustBucket(t, dst, "accounts").Put([]byte("50"), nil); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	err = dst.ChangesSince(50, func(event Event) bool {
+		seqs = append(seqs, event.Seq)
+		return true
+	})
+	if err != nil || fmt.Sprint(seqs) != "[51]" {
+		t.Fatalf("expected the change after the copy to be 51 but got %v %v", seqs, err)
+	}
+
+	if record := dst.meta.record(indexBucketName("accounts", "user")); record != nil {
+		t.Fatal("expected the index not to be copied")
+	}
+
+	if problems := dst.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems but got %v", problems)
+	}
+}
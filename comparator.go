@@ -0,0 +1,178 @@
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// maxComparatorName is the longest comparator name, it is stored in the
+// meta record of every bucket using the comparator
+const maxComparatorName = 16
+
+// Comparator orders the keys of a bucket. Compare returns a negative number
+// when a sorts before b, a positive one when it sorts after and zero only
+// when the keys are equal. the name is stored with the bucket, so a bucket
+// can only be opened again with a comparator of the same name
+type Comparator struct {
+	Name    string
+	Compare func(a []byte, b []byte) int
+}
+
+var (
+	// NumericComparator orders keys naturally, runs of digits are compared
+	// by the number they make, so "item9" sorts before "item10"
+	NumericComparator = Comparator{Name: "numeric", Compare: compareNumeric}
+	// CaseInsensitiveComparator orders keys ignoring the case of ASCII
+	// letters. keys that only differ in case are still different keys
+	CaseInsensitiveComparator = Comparator{Name: "case-insensitive", Compare: compareCaseInsensitive}
+	// ReverseComparator orders keys in descending byte order
+	ReverseComparator = Comparator{Name: "reverse", Compare: compareReverse}
+)
+
+// builtinComparators are found by name, they do not need to be configured
+// again to open the buckets created with them
+var builtinComparators = map[string]Comparator{
+	NumericComparator.Name:         NumericComparator,
+	CaseInsensitiveComparator.Name: CaseInsensitiveComparator,
+	ReverseComparator.Name:         ReverseComparator,
+}
+
+// compare orders keys with the comparator of the bucket, bytes.Compare if
+// it has none
+func (b *bucket) compare(x []byte, y []byte) int {
+	if b.comparator.Compare == nil {
+		return bytes.Compare(x, y)
+	}
+
+	return b.comparator.Compare(x, y)
+}
+
+// loadComparators checks the configured comparators against the ones the
+// buckets were created with and finds the comparators of the buckets that
+// are not configured
+func (db *DB) loadComparators() error {
+	db.comparators = make(map[string]Comparator)
+	for name, comparator := range db.config.Comparators {
+		if comparator.Name == "" || comparator.Compare == nil {
+			return fmt.Errorf("comparator of bucket %s needs a name and a compare function", name)
+		}
+		if len(comparator.Name) > maxComparatorName {
+			return fmt.Errorf("comparator name %s is longer than %d bytes", comparator.Name, maxComparatorName)
+		}
+		db.comparators[name] = comparator
+	}
+
+	for _, record := range db.meta.buckets {
+		if err := db.useComparator(record.name, record.comparator); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// useComparator makes bucket use the named comparator, an empty name being
+// bytes.Compare. it fails if the bucket is configured with another one
+func (db *DB) useComparator(bucket string, name string) error {
+	comparator, ok := db.comparators[bucket]
+	if ok || name == "" {
+		if comparator.Name != name {
+			return fmt.Errorf("bucket %s uses comparator %q but is opened with %q", bucket, name, comparator.Name)
+		}
+		return nil
+	}
+
+	comparator, ok = builtinComparators[name]
+	if !ok {
+		return fmt.Errorf("bucket %s uses comparator %q, it must be set in Config.Comparators", bucket, name)
+	}
+	db.comparators[bucket] = comparator
+
+	return nil
+}
+
+func compareNumeric(a []byte, b []byte) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			if a[i] != b[j] {
+				return compareByte(a[i], b[j])
+			}
+			i++
+			j++
+			continue
+		}
+
+		// compare the numbers made by the runs of digits, a longer number
+		// without its leading zeros is a larger one
+		si, sj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
+		}
+
+		x := bytes.TrimLeft(a[si:i], "0")
+		y := bytes.TrimLeft(b[sj:j], "0")
+		if len(x) != len(y) {
+			return compareInt(len(x), len(y))
+		}
+		if c := bytes.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+
+	if i < len(a) || j < len(b) {
+		return compareInt(len(a)-i, len(b)-j)
+	}
+
+	// keys like "a01" and "a1" are the same number but different keys
+	return bytes.Compare(a, b)
+}
+
+func compareCaseInsensitive(a []byte, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if x, y := toLower(a[i]), toLower(b[i]); x != y {
+			return compareByte(x, y)
+		}
+	}
+
+	if len(a) != len(b) {
+		return compareInt(len(a), len(b))
+	}
+
+	return bytes.Compare(a, b)
+}
+
+func compareReverse(a []byte, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func compareByte(x byte, y byte) int {
+	if x < y {
+		return -1
+	}
+	return 1
+}
+
+func compareInt(x int, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,183 @@
+package kvdb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// keys returns the keys of the bucket in the order Scan returns them
+func keys(b *Bucket) []string {
+	var keys []string
+	b.Scan(func(key []byte, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	return keys
+}
+
+func TestComparators(t *testing.T) {
+	tests := []struct {
+		comparator Comparator
+		keys       []string
+	}{
+		{NumericComparator, []string{"", "01", "1", "2", "9", "10", "099", "100", "a", "a1", "a2", "a10", "a10b", "b"}},
+		{CaseInsensitiveComparator, []string{"", "_", "A", "a", "aB", "ab", "B", "b", "ba", "Z"}},
+		{ReverseComparator, []string{"b", "ab", "aa", "a", ""}},
+	}
+
+	for _, test := range tests {
+		if !sort.SliceIsSorted(test.keys, func(i, j int) bool {
+			return test.comparator.Compare([]byte(test.keys[i]), []byte(test.keys[j])) < 0
+		}) {
+			t.Fatalf("%s: expected %q to be in order", test.comparator.Name, test.keys)
+		}
+
+		for i, key := range test.keys {
+			for j, other := range test.keys {
+				c := test.comparator.Compare([]byte(key), []byte(other))
+				if (c < 0) != (i < j) || (c == 0) != (i == j) {
+					t.Fatalf("%s: comparing %q and %q gave %d", test.comparator.Name, key, other, c)
+				}
+			}
+		}
+	}
+}
+
+func TestBucketComparator(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 2, Comparators: map[string]Comparator{"items": NumericComparator}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := mustBucket(t, db, "items")
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		if err := items.Put([]byte(fmt.Sprintf("item%d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := items.Put([]byte("other"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for i := 0; i < 100; i++ {
+		expected = append(expected, fmt.Sprintf("item%d", i))
+	}
+	if fmt.Sprint(keys(items)) != fmt.Sprint(append(expected, "other")) {
+		t.Fatalf("expected the keys in numeric order but got %v", keys(items))
+	}
+
+	if value, err := items.Get([]byte("item42")); err != nil || string(value) != "42" {
+		t.Fatalf("expected item42 to be 42 but got %q %v", value, err)
+	}
+
+	var scanned []string
+	items.ScanRange([]byte("item9"), []byte("item11"), func(key []byte, value []byte) bool {
+		scanned = append(scanned, string(key))
+		return true
+	})
+	if fmt.Sprint(scanned) != "[item9 item10]" {
+		t.Fatalf("expected the keys in [item9, item11) but got %v", scanned)
+	}
+
+	scanned = nil
+	items.ScanPrefixRange([]byte("item1"), []byte("item11"), []byte("item100"), func(key []byte, value []byte) bool {
+		scanned = append(scanned, string(key))
+		return true
+	})
+	if fmt.Sprint(scanned) != "[item11 item12 item13 item14 item15 item16 item17 item18 item19]" {
+		t.Fatalf("expected the keys starting with item1 in [item11, item100) but got %v", scanned)
+	}
+
+	if n, err := items.DeletePrefix([]byte("item1")); err != nil || n != 11 {
+		t.Fatalf("expected 11 keys to be deleted but got %d %v", n, err)
+	}
+	items.ScanPrefix([]byte("item1"), func(key []byte, value []byte) bool {
+		t.Fatalf("expected no key with the prefix but got %s", key)
+		return false
+	})
+
+	if problems := db.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems but got %v", problems)
+	}
+
+	// other buckets keep the byte order
+	if err := mustBucket(t, db, "users").Put([]byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	// built-in comparators are found by name
+	db, err = Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(mustBucket(t, db, "items")); got[0] != "item0" || got[1] != "item2" {
+		t.Fatalf("expected the keys in numeric order after reopening but got %v", got)
+	}
+	db.Close()
+
+	for _, comparators := range []map[string]Comparator{
+		{"items": ReverseComparator},
+		{"users": NumericComparator},
+		{"items": {Name: "numeric"}},
+	} {
+		if db, err := Open(path, &Config{Comparators: comparators}); err == nil {
+			db.Close()
+			t.Fatalf("expected opening with %v to fail", comparators)
+		}
+	}
+}
+
+func TestBucketCustomComparator(t *testing.T) {
+	// keys are ordered by their length first
+	byLength := Comparator{Name: "length", Compare: func(a []byte, b []byte) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return bytes.Compare(a, b)
+	}}
+
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 2, Comparators: map[string]Comparator{"words": byLength}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, word := range []string{"ccc", "a", "bb", "dddd", "b"} {
+		if err := mustBucket(t, db, "words").Put([]byte(word), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	if _, err := Open(path, nil); err == nil {
+		t.Fatal("expected opening without the comparator to fail")
+	}
+
+	db, err = Open(path, &Config{Comparators: map[string]Comparator{"words": byLength}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the copy keeps the comparator
+	dst, err := Open(tempDBPath(t)+".compact", &Config{Comparators: map[string]Comparator{"words": byLength}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := Compact(dst, db, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(keys(mustBucket(t, dst, "words"))); got != "[a b bb ccc dddd]" {
+		t.Fatalf("expected the copied keys by length but got %v", got)
+	}
+}
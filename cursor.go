@@ -1,7 +1,6 @@
 package kvdb
 
 import (
-	"bytes"
 	"fmt"
 )
 
@@ -15,11 +14,11 @@ func newCursor(b *Bucket) Cursor {
 }
 
 func (c *Cursor) seek(seek []byte) *Node {
-	return c.search(c.bucket.root, seek)
+	return c.search(c.bucket.root, 0, seek)
 }
 
-func (c *Cursor) search(pgid uint64, seek []byte) *Node {
-	node := c.bucket.node(pgid)
+func (c *Cursor) search(pgid uint64, parent uint64, seek []byte) *Node {
+	node := c.bucket.load(pgid, parent)
 	c.stack = append(c.stack, node)
 
 	// if node is leaf, return it
@@ -29,8 +28,8 @@ func (c *Cursor) search(pgid uint64, seek []byte) *Node {
 
 	// if node is internal, search for the child node
 	for i, key := range node.Keys {
-		if bytes.Compare(key, seek) > 0 {
-			return c.search(node.children[i], seek)
+		if c.bucket.compare(key, seek) > 0 {
+			return c.search(node.children[i], node.pgid, seek)
 		}
 	}
 
@@ -44,7 +43,7 @@ func (c *Cursor) search(pgid uint64, seek []byte) *Node {
 	}
 
 	// if seek is greater than all keys, return the last child node
-	return c.search(node.children[len(node.children)-1], seek)
+	return c.search(node.children[len(node.children)-1], node.pgid, seek)
 }
 
 func (c Cursor) freeStack() {
@@ -2,6 +2,9 @@ package kvdb
 
 import (
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -13,35 +16,145 @@ const (
 	NODE_TYPE_LEAF     = 0x02
 	MAX_KEYS_PER_NODE  = 5
 
+	// other page types
+	PAGE_TYPE_FREELIST = 0x03
+	PAGE_TYPE_META     = 0x04
+
 	// key/value length
 	KEY_SIZE   = 100 // 100 bytes
 	VALUE_SIZE = 100 // 3000 bytes
 
-	// DB_HEADER SIZE
-	DB_HEADER = 0 + META_PAGE_SIZE
+	// DB_HEADER SIZE, the two copies of the meta page
+	DB_HEADER = 2 * META_PAGE_SIZE
 )
 
+// internalBucketPrefix starts the names of buckets the database keeps for
+// itself, like the expiry indexes of PutWithTTL
+const internalBucketPrefix = "\x00"
+
+func isInternalBucket(name string) bool {
+	return strings.HasPrefix(name, internalBucketPrefix)
+}
+
 type DB struct {
 	file   *os.File
 	path   string
 	config Config
 
 	meta *Meta
+
+	buckets map[string]*bucket // buckets opened so far, keyed by name
+	mu      sync.Mutex         // guards buckets
+
+	comparators map[string]Comparator // comparators of the buckets that do not use bytes.Compare
+
+	rwlock sync.RWMutex // allows one writable transaction or many read-only ones
+
+	batchMu sync.Mutex
+	batch   *batch
+
+	closing   chan struct{} // closed when the database is closing
+	sweeperWg sync.WaitGroup
+
+	backupsMu sync.Mutex
+	backups   []*backup // backups being copied by WriteTo
+
+	counters counters
+
+	watchMu  sync.Mutex
+	watchers []*watcher // channels returned by Watch
 }
 
 type Config struct {
 	maxKeysPerNode int
-	callOnSplit    func()
+	now            func() time.Time // clock used for key expiry, time.Now by default
+
+	// Hooks are told about splits, page allocations, commits and other
+	// events. nil uses NopHooks
+	Hooks Hooks
+
+	// MaxBatchSize is the maximum number of calls DB.Batch groups into
+	// one transaction. zero uses the default of 1000
+	MaxBatchSize int
+	// MaxBatchDelay is how long DB.Batch waits for more calls before
+	// committing a batch that is not full. zero uses the default of 10ms
+	MaxBatchDelay time.Duration
+
+	// TTLSweepInterval is how often expired keys are removed in the
+	// background. zero uses the default of 1s, a negative value disables
+	// the sweeper
+	TTLSweepInterval time.Duration
+	// TTLSweepBatch is the maximum number of expired keys removed from a
+	// bucket in one transaction. zero uses the default of 1000
+	TTLSweepBatch int
+	// OnSweepError is called with the errors of the sweeper, like a page
+	// that cannot be read, it keeps sweeping at the next interval. nil
+	// ignores them
+	OnSweepError func(error)
+
+	// ChangeLog keeps every change of the user buckets in the file, so
+	// they can be read again with ChangesSince after a restart
+	ChangeLog bool
+
+	// Comparators orders the keys of the named buckets with a comparator
+	// other than bytes.Compare. a bucket keeps the comparator it was
+	// created with, Open fails if it is configured with another one
+	Comparators map[string]Comparator
 }
 
+// Open opens the database file at path, creating it if it does not exist.
+// files written in another format version fail with ErrFormatVersion
 func Open(path string, config *Config) (*DB, error) {
 	if config == nil {
-		config = &Config{maxKeysPerNode: 3}
+		config = &Config{}
 	}
-	return newDB(path, *config)
+
+	c := *config
+	if c.maxKeysPerNode == 0 {
+		c.maxKeysPerNode = 3
+	}
+	if c.MaxBatchSize == 0 {
+		c.MaxBatchSize = 1000
+	}
+	if c.MaxBatchDelay == 0 {
+		c.MaxBatchDelay = 10 * time.Millisecond
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+	if c.Hooks == nil {
+		c.Hooks = NopHooks{}
+	}
+	if c.TTLSweepInterval == 0 {
+		c.TTLSweepInterval = time.Second
+	}
+	if c.TTLSweepBatch == 0 {
+		c.TTLSweepBatch = 1000
+	}
+
+	return newDB(path, c)
 }
 
+// Close stops the expiry sweeper, waits for running transactions to finish,
+// closes the channels of the watchers and closes the file
 func (db *DB) Close() error {
+	select {
+	case <-db.closing:
+	default:
+		close(db.closing)
+	}
+	db.sweeperWg.Wait()
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	// watchers get no more events
+	db.watchMu.Lock()
+	for len(db.watchers) > 0 {
+		db.unwatch(db.watchers[0])
+	}
+	db.watchMu.Unlock()
+
 	return db.file.Close()
 }
 
@@ -59,34 +172,135 @@ func newDB(path string, config Config) (*DB, error) {
 	}
 
 	db := &DB{
-		file:   file,
-		path:   path,
-		config: config,
+		file:    file,
+		path:    path,
+		config:  config,
+		buckets: make(map[string]*bucket),
+		closing: make(chan struct{}),
 	}
 
 	if fi.Size() == 0 {
 		err := db.newMeta()
 		if err != nil {
+			file.Close()
 			return nil, err
 		}
 	} else {
 		db.meta, err = db.readMeta()
 		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		err = db.readFreelist()
+		if err != nil {
+			file.Close()
 			return nil, err
 		}
 	}
 
+	if err := db.loadComparators(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if config.TTLSweepInterval > 0 {
+		db.sweeperWg.Add(1)
+		go db.sweeper()
+	}
+
 	return db, nil
 }
 
-func (db *DB) Bucket(s string) *Bucket {
-	// find bucket in meta page
-	for _, record := range db.meta.buckets {
-		if record.name == s {
-			return newBucket(db, record.rootpage)
+// sync flushes the file to disk
+func (db *DB) sync() error {
+	start := time.Now()
+	if err := db.file.Sync(); err != nil {
+		return err
+	}
+	db.counters.syncLatency.observe(time.Since(start))
+
+	return nil
+}
+
+func (db *DB) now() time.Time {
+	return db.config.now()
+}
+
+// Bucket returns a handle of the named bucket, creating the bucket if it does
+// not exist. every call on the handle runs in a transaction of its own, so
+// Bucket must not be called from inside a transaction, use Tx.Bucket there.
+// creating a bucket fails if it cannot be written to disk, or its record
+// does not fit in the meta page with the others, see ErrTooManyBuckets
+func (db *DB) Bucket(s string) (*Bucket, error) {
+	var b *bucket
+	db.View(func(tx *Tx) error {
+		if handle := tx.Bucket(s); handle != nil {
+			b = handle.bucket
 		}
+		return nil
+	})
+
+	if b != nil {
+		return &Bucket{bucket: b}, nil
+	}
+
+	err := db.Update(func(tx *Tx) error {
+		b = tx.Bucket(s).bucket
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bucket{bucket: b}, nil
+}
+
+// Buckets returns the names of the buckets in the order they were created,
+// leaving out the buckets the database keeps for itself
+func (db *DB) Buckets() []string {
+	var names []string
+	db.View(func(tx *Tx) error {
+		names = tx.Buckets()
+		return nil
+	})
+
+	return names
+}
+
+// bucket returns the shared state of the named bucket. if the bucket does not
+// exist it is created when create is true, otherwise nil is returned
+func (db *DB) bucket(s string, create bool) *bucket {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if b, ok := db.buckets[s]; ok {
+		return b
+	}
+
+	// find bucket in meta page
+	record := db.meta.record(s)
+	if record != nil {
+		b := newBucket(db, record.name, record.rootpage)
+		db.buckets[s] = b
+
+		return b
+	}
+
+	if !create {
+		return nil
 	}
 
 	// if bucket not found, create new bucket
-	return db.meta.newBucket(db, s)
+	record = db.meta.newBucket(s, db.allocate(), db.comparators[s].Name)
+	b := newBucket(db, record.name, record.rootpage)
+	db.buckets[s] = b
+
+	// the root page may be a reused one, so the empty root must be written
+	// instead of loading whatever the page holds
+	root := newNode(&Bucket{bucket: b}, record.rootpage, NODE_TYPE_LEAF)
+	root.dirty = true
+	b.nodes[root.pgid] = root
+
+	return b
 }
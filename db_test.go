@@ -1,13 +1,46 @@
 package kvdb
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// tempDBPath returns a path for a fresh database file removed when the test ends
+func tempDBPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.db")
+}
+
+// mustBucket returns a handle of the named bucket, creating it
+func mustBucket(t testing.TB, db *DB, name string) *Bucket {
+	t.Helper()
+
+	bucket, err := db.Bucket(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bucket
+}
+
+// splitHooks calls fn after every split
+type splitHooks struct {
+	NopHooks
+	fn func()
+}
+
+func (h splitHooks) OnSplit(bucket string, pgid uint64, sibling uint64) {
+	h.fn()
+}
+
 func injectAndPrintMermaid(db *DB, bucket *Bucket) func() {
 	var mermaidDevs []string
-	db.config.callOnSplit = func() {
+	db.config.Hooks = splitHooks{fn: func() {
 		newMermaid := MermaidHtml(bucket)
 		// check if the new mermaid is not the same as the previous one
 		if len(mermaidDevs) > 0 && mermaidDevs[len(mermaidDevs)-1] == newMermaid {
@@ -15,7 +48,7 @@ func injectAndPrintMermaid(db *DB, bucket *Bucket) func() {
 		}
 
 		mermaidDevs = append(mermaidDevs, newMermaid)
-	}
+	}}
 
 	return func() {
 		mermaidDevs = append(mermaidDevs, MermaidHtml(bucket))
@@ -24,14 +57,14 @@ func injectAndPrintMermaid(db *DB, bucket *Bucket) func() {
 }
 
 func TestDB(t *testing.T) {
-	db, err := Open("test.db", nil)
+	db, err := Open(tempDBPath(t), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
 
-	bucket := db.Bucket("user_emails")
+	bucket := mustBucket(t, db, "user_emails")
 
 	err = bucket.Put([]byte("user1"), []byte("user1@email.com"))
 	if err != nil {
@@ -40,19 +73,19 @@ func TestDB(t *testing.T) {
 }
 
 func TestDBInsertMultiple(t *testing.T) {
-	db, err := Open("test.db", nil)
+	db, err := Open(tempDBPath(t), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
-	bucket := db.Bucket("user_emails")
+	bucket := mustBucket(t, db, "user_emails")
 
 	// names are sorted in a way to catch sorting issues if splitting is picking different keys
 	names := []string{"Ibrahim", "Gamal", "Hassan", "Camal", "Basem", "Dawood", "Emad", "Ahmed", "Fady"}
 
 	var mermaidDevs []string
-	db.config.callOnSplit = func() {
+	db.config.Hooks = splitHooks{fn: func() {
 		newMermaid := MermaidHtml(bucket)
 		// check if the new mermaid is not the same as the previous one
 		if len(mermaidDevs) > 0 && mermaidDevs[len(mermaidDevs)-1] == newMermaid {
@@ -60,7 +93,7 @@ func TestDBInsertMultiple(t *testing.T) {
 		}
 
 		mermaidDevs = append(mermaidDevs, newMermaid)
-	}
+	}}
 
 	for _, name := range names {
 		err = bucket.Put([]byte(name), []byte(fmt.Sprintf("%s@email.com", name)))
@@ -74,14 +107,14 @@ func TestDBInsertMultiple(t *testing.T) {
 }
 
 func TestDBScanRecords(t *testing.T) {
-	db, err := Open("test.db", nil)
+	db, err := Open(tempDBPath(t), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
 
-	bucket := db.Bucket("user_emails")
+	bucket := mustBucket(t, db, "user_emails")
 
 	err = bucket.Put([]byte("Zanzibar"), []byte("zanzibar@gmail.com"))
 	if err != nil {
@@ -114,15 +147,188 @@ func TestDBScanRecords(t *testing.T) {
 	}
 }
 
+func TestDBScanRange(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "tenants")
+	for _, tenant := range []string{"1", "2", "3"} {
+		for i := 0; i < 10; i++ {
+			err = bucket.Put([]byte(fmt.Sprintf("tenant:%s:%02d", tenant, i)), []byte("x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := mustBucket(t, db, "sessions").PutWithTTL([]byte("session"), []byte("x"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	bucket.ScanPrefix([]byte("tenant:2:"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	if len(keys) != 10 || keys[0] != "tenant:2:00" || keys[9] != "tenant:2:09" {
+		t.Fatalf("expected the 10 keys of tenant 2 but got %v", keys)
+	}
+
+	keys = []string{}
+	bucket.ScanRange([]byte("tenant:1:05"), []byte("tenant:2:02"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 6
+	})
+
+	expected := []string{"tenant:1:05", "tenant:1:06", "tenant:1:07", "tenant:1:08", "tenant:1:09", "tenant:2:00"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, keys)
+	}
+
+	keys = []string{}
+	bucket.ScanRange(nil, []byte("tenant:1:02"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	if fmt.Sprint(keys) != fmt.Sprint([]string{"tenant:1:00", "tenant:1:01"}) {
+		t.Fatalf("expected the first 2 keys but got %v", keys)
+	}
+
+	keys = []string{}
+	bucket.ScanRangeReverse([]byte("tenant:1:08"), []byte("tenant:2:02"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	expected = []string{"tenant:2:01", "tenant:2:00", "tenant:1:09", "tenant:1:08"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, keys)
+	}
+
+	keys = []string{}
+	bucket.ScanPrefixRangeReverse([]byte("tenant:3:"), nil, []byte("tenant:3:05"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 3
+	})
+
+	expected = []string{"tenant:3:04", "tenant:3:03", "tenant:3:02"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v but got %v", expected, keys)
+	}
+
+	// every key from the last one
+	keys = []string{}
+	bucket.ScanRangeReverse(nil, nil, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	if len(keys) != 30 || keys[0] != "tenant:3:09" || keys[29] != "tenant:1:00" {
+		t.Fatalf("expected the 30 keys from the last one but got %v", keys)
+	}
+
+	// the expiry indexes of sessions are not listed
+	if buckets := db.Buckets(); fmt.Sprint(buckets) != fmt.Sprint([]string{"tenants", "sessions"}) {
+		t.Fatalf("expected buckets tenants and sessions but got %v", buckets)
+	}
+}
+
+func TestDBFormatVersion(t *testing.T) {
+	for _, version := range []struct{ magic, version uint32 }{
+		{0, 0},                         // written before versions
+		{metaMagic, formatVersion + 1}, // written by a newer version
+	} {
+		path := tempDBPath(t)
+		db, err := Open(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mustBucket(t, db, "users").Put([]byte("1"), []byte("ahmed")); err != nil {
+			t.Fatal(err)
+		}
+
+		// both copies of the meta page
+		for txid := uint64(0); txid < 2; txid++ {
+			page, err := db.readPageAt(0, metaOffset(txid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			binary.LittleEndian.PutUint32(page[pageHeaderSize:pageHeaderSize+4], version.magic)
+			binary.LittleEndian.PutUint32(page[pageHeaderSize+4:pageHeaderSize+8], version.version)
+			if err := db.writePageAt(0, PAGE_TYPE_META, page, metaOffset(txid)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		if _, err := Open(path, nil); !errors.Is(err, ErrFormatVersion) {
+			t.Fatalf("expected ErrFormatVersion for magic %x version %d but got %v", version.magic, version.version, err)
+		}
+	}
+}
+
+func TestDBManyBuckets(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// records only take the room their names need
+	for i := 0; i < 100; i++ {
+		mustBucket(t, db, fmt.Sprintf("bucket%d", i))
+	}
+	db.Close()
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if n := len(db.Buckets()); n != 100 {
+		t.Fatalf("expected 100 buckets but got %d", n)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			tx.Bucket(strings.Repeat("x", 100) + fmt.Sprint(i))
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrTooManyBuckets) {
+		t.Fatalf("expected ErrTooManyBuckets but got %v", err)
+	}
+	if n := len(db.Buckets()); n != 100 {
+		t.Fatalf("expected the buckets of the failed transaction to be dropped but got %d", n)
+	}
+
+	for i := 0; ; i++ {
+		_, err := db.Bucket(strings.Repeat("x", 100) + fmt.Sprint(i))
+		if errors.Is(err, ErrTooManyBuckets) {
+			break
+		}
+		if err != nil || i == 100 {
+			t.Fatalf("expected ErrTooManyBuckets from Bucket but got %v", err)
+		}
+	}
+}
+
 func TestDBGet(t *testing.T) {
-	db, err := Open("test.db", nil)
+	db, err := Open(tempDBPath(t), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
 
-	bucket := db.Bucket("user_emails")
+	bucket := mustBucket(t, db, "user_emails")
 
 	countryEmails := map[string]string{
 		"Zanzibar": "zanzibar@gmail.com",
@@ -156,14 +362,14 @@ func TestDBGet(t *testing.T) {
 }
 
 func TestDBUpdate(t *testing.T) {
-	db, err := Open("test.db", nil)
+	db, err := Open(tempDBPath(t), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
 
-	bucket := db.Bucket("user_emails")
+	bucket := mustBucket(t, db, "user_emails")
 
 	err = bucket.Put([]byte("ahmed"), []byte("ahmed@gmail.com"))
 	if err != nil {
@@ -185,15 +391,77 @@ func TestDBUpdate(t *testing.T) {
 	}
 }
 
+func TestDBLargeValues(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "files")
+
+	// three of them do not fit in a page
+	for i := 0; i < 20; i++ {
+		value := strings.Repeat(fmt.Sprint(i%10), 1500)
+		if err := bucket.Put([]byte(fmt.Sprintf("file:%02d", i)), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// growing values splits the node they are in
+	for i := 0; i < 20; i += 3 {
+		value := strings.Repeat(fmt.Sprint(i%10), 3000)
+		if err := bucket.Update([]byte(fmt.Sprintf("file:%02d", i)), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bucket.Put([]byte("big"), make([]byte, PAGE_SIZE)); err != ErrValueTooLarge {
+		t.Fatalf("expected %v but got %v", ErrValueTooLarge, err)
+	}
+	if err := bucket.Put(make([]byte, MaxKeySize+1), nil); err != ErrKeyTooLarge {
+		t.Fatalf("expected %v but got %v", ErrKeyTooLarge, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		size := 1500
+		if i%3 == 0 {
+			size = 3000
+		}
+
+		value, err := mustBucket(t, db, "files").Get([]byte(fmt.Sprintf("file:%02d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != strings.Repeat(fmt.Sprint(i%10), size) {
+			t.Fatalf("file:%02d has %d bytes, expected %d", i, len(value), size)
+		}
+	}
+
+	if errs := db.Check(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+}
+
 func TestDBDelete(t *testing.T) {
-	db, err := Open("test.db", &Config{maxKeysPerNode: 2})
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
 
-	bucket := db.Bucket("user_emails")
+	bucket := mustBucket(t, db, "user_emails")
 
 	defer injectAndPrintMermaid(db, bucket)()
 
@@ -217,14 +485,14 @@ func TestDBDelete(t *testing.T) {
 }
 
 func TestFreeList(t *testing.T) {
-	db, err := Open("test.db", &Config{maxKeysPerNode: 2})
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	defer db.Close()
 
-	bucket := db.Bucket("user_emails")
+	bucket := mustBucket(t, db, "user_emails")
 
 	defer injectAndPrintMermaid(db, bucket)()
 
@@ -246,3 +514,226 @@ func TestFreeList(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDBDeleteRange(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "numbers")
+	for i := 0; i < 200; i++ {
+		err = bucket.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := bucket.DeleteRange([]byte("010"), []byte("150"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 140 {
+		t.Fatalf("expected 140 deleted keys but got %d", count)
+	}
+
+	for i := 0; i < 200; i++ {
+		_, err := bucket.Get([]byte(fmt.Sprintf("%03d", i)))
+		if i >= 10 && i < 150 && err == nil {
+			t.Fatalf("expected key %03d to be deleted", i)
+		}
+		if (i < 10 || i >= 150) && err != nil {
+			t.Fatalf("expected key %03d to exist but got %v", i, err)
+		}
+	}
+
+	if len(db.meta.freelist) == 0 {
+		t.Fatal("expected released pages in the freelist")
+	}
+
+	// released pages are reused before the file grows
+	pgid := db.meta.pgid
+	for i := 10; i < 150; i++ {
+		err = bucket.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if db.meta.pgid != pgid {
+		t.Fatalf("expected no new pages but last page went from %d to %d", pgid, db.meta.pgid)
+	}
+
+	count, err = bucket.DeleteRange(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 200 {
+		t.Fatalf("expected 200 deleted keys but got %d", count)
+	}
+}
+
+func TestDBDeletePrefix(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "tenants")
+	for _, tenant := range []string{"1", "2", "3"} {
+		for i := 0; i < 30; i++ {
+			err = bucket.Put([]byte(fmt.Sprintf("tenant:%s:%02d", tenant, i)), []byte("x"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	count, err := bucket.DeletePrefix([]byte("tenant:2:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 30 {
+		t.Fatalf("expected 30 deleted keys but got %d", count)
+	}
+
+	free := len(db.meta.freelist)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the freelist survives reopening the file
+	db, err = Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if len(db.meta.freelist) != free {
+		t.Fatalf("expected %d free pages after reopen but got %d", free, len(db.meta.freelist))
+	}
+
+	keys := 0
+	mustBucket(t, db, "tenants").Scan(func(key, value []byte) bool {
+		if strings.HasPrefix(string(key), "tenant:2:") {
+			t.Fatalf("expected key %s to be deleted", key)
+		}
+		keys++
+		return true
+	})
+
+	if keys != 60 {
+		t.Fatalf("expected 60 keys but got %d", keys)
+	}
+}
+
+func TestDBConditionalWrites(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "locks")
+
+	ok, err := bucket.PutIfAbsent([]byte("job"), []byte("worker1"))
+	if err != nil || !ok {
+		t.Fatalf("expected first PutIfAbsent to write but got %v %v", ok, err)
+	}
+
+	ok, err = bucket.PutIfAbsent([]byte("job"), []byte("worker2"))
+	if err != nil || ok {
+		t.Fatalf("expected second PutIfAbsent to be skipped but got %v %v", ok, err)
+	}
+
+	ok, err = bucket.CompareAndSwap([]byte("job"), []byte("worker2"), []byte("worker3"))
+	if err != nil || ok {
+		t.Fatalf("expected CompareAndSwap with a stale value to be skipped but got %v %v", ok, err)
+	}
+
+	ok, err = bucket.CompareAndSwap([]byte("job"), []byte("worker1"), []byte("worker3"))
+	if err != nil || !ok {
+		t.Fatalf("expected CompareAndSwap to swap but got %v %v", ok, err)
+	}
+
+	ok, err = bucket.CompareAndSwap([]byte("missing"), nil, []byte("worker3"))
+	if err != nil || ok {
+		t.Fatalf("expected CompareAndSwap on a missing key to be skipped but got %v %v", ok, err)
+	}
+
+	ok, err = bucket.DeleteIfEquals([]byte("job"), []byte("worker1"))
+	if err != nil || ok {
+		t.Fatalf("expected DeleteIfEquals with a stale value to be skipped but got %v %v", ok, err)
+	}
+
+	ok, err = bucket.DeleteIfEquals([]byte("job"), []byte("worker3"))
+	if err != nil || !ok {
+		t.Fatalf("expected DeleteIfEquals to delete but got %v %v", ok, err)
+	}
+
+	if _, err := bucket.Get([]byte("job")); err == nil {
+		t.Fatal("expected job to be deleted")
+	}
+}
+
+func TestDBCompareAndSwapConcurrent(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "counters")
+	if err := bucket.Put([]byte("hits"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// every goroutine retries until its increment lands, so none is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					value, err := bucket.Get([]byte("hits"))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					var n int
+					fmt.Sscan(string(value), &n)
+
+					ok, err := bucket.CompareAndSwap([]byte("hits"), value, []byte(fmt.Sprint(n+1)))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := bucket.Get([]byte("hits"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "100" {
+		t.Fatalf("expected 100 hits but got %s", value)
+	}
+}
@@ -0,0 +1,168 @@
+package kvdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// freelist page layout after the page header
+//
+//	[13:21]  next freelist page id, 0 for the last page
+//	[21:23]  number of page ids
+//	free page ids, 8 bytes each
+const (
+	freelistHeaderSize = pageHeaderSize + 10
+	freelistPageIDs    = (PAGE_SIZE - freelistHeaderSize) / 8
+)
+
+// free gives a page back to the freelist so getNewPageID can reuse it. a
+// page the file still uses is only reused after the transaction commits
+func (m *Meta) free(pgid uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.allocated[pgid] {
+		m.pending = append(m.pending, pgid)
+		return
+	}
+	delete(m.allocated, pgid)
+
+	i := sort.Search(len(m.freelist), func(i int) bool { return m.freelist[i] >= pgid })
+	if i < len(m.freelist) && m.freelist[i] == pgid {
+		panic(fmt.Sprintf("page %d is already free", pgid))
+	}
+
+	m.freelist = append(m.freelist, 0)
+	copy(m.freelist[i+1:], m.freelist[i:])
+	m.freelist[i] = pgid
+}
+
+// release makes the pages freed by the transaction that just committed
+// reusable, free are the ids its freelist chain holds
+func (m *Meta) release(free []uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.freelist = free
+	m.pending = nil
+	m.allocated = nil
+}
+
+// free removes the node from memory and releases its page
+func (b *Bucket) free(n *Node) {
+	b.mu.Lock()
+	delete(b.nodes, n.pgid)
+	b.mu.Unlock()
+
+	b.freePage(n.pgid)
+}
+
+func (b *Bucket) freePage(pgid uint64) {
+	b.db.meta.free(pgid)
+	b.db.counters.pageFreeN.Add(1)
+	b.db.config.Hooks.OnPageFree(pgid)
+}
+
+// allocate returns the id of a page for a new node or the freelist
+func (db *DB) allocate() uint64 {
+	pgid := db.meta.getNewPageID()
+	db.counters.pageAllocN.Add(1)
+	db.config.Hooks.OnPageAlloc(pgid)
+
+	return pgid
+}
+
+// writeFreelist stores the free page ids in a new chain of pages and returns
+// them. the pages freed by the transaction and the old chain are stored as
+// free but not overwritten, the file uses them until the meta page is
+// written. the new chain is allocated like the pages of nodes
+func (db *DB) writeFreelist() ([]uint64, error) {
+	m := db.meta
+
+	var chain []uint64
+	for len(chain)*freelistPageIDs < len(m.freelist)+len(m.pending)+len(m.chain) {
+		chain = append(chain, db.allocate())
+	}
+
+	for _, pgid := range m.chain {
+		db.counters.pageFreeN.Add(1)
+		db.config.Hooks.OnPageFree(pgid)
+	}
+
+	ids := append(append(append([]uint64{}, m.freelist...), m.pending...), m.chain...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, pgid := range chain {
+		start := i * freelistPageIDs
+		if start > len(ids) {
+			start = len(ids)
+		}
+		end := start + freelistPageIDs
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var next uint64
+		if i+1 < len(chain) {
+			next = chain[i+1]
+		}
+
+		buf := make([]byte, PAGE_SIZE)
+		binary.LittleEndian.PutUint64(buf[13:21], next)
+		binary.LittleEndian.PutUint16(buf[21:23], uint16(end-start))
+		for j, id := range ids[start:end] {
+			offset := freelistHeaderSize + j*8
+			binary.LittleEndian.PutUint64(buf[offset:offset+8], id)
+		}
+
+		if err := db.writePage(pgid, PAGE_TYPE_FREELIST, buf); err != nil {
+			return nil, err
+		}
+	}
+
+	m.chain = chain
+	m.freelistPage = 0
+	if len(chain) > 0 {
+		m.freelistPage = chain[0]
+	}
+
+	return ids, nil
+}
+
+// readFreelist loads the free page ids from the chain starting at the page
+// recorded in the meta page
+func (db *DB) readFreelist() error {
+	freelist := make([]uint64, 0)
+	var chain []uint64
+
+	for pgid := db.meta.freelistPage; pgid != 0; {
+		buf, err := db.readPage(pgid)
+		if err != nil {
+			return fmt.Errorf("read freelist page %d: %w", pgid, err)
+		}
+
+		if buf[8] != PAGE_TYPE_FREELIST {
+			return fmt.Errorf("page %d is not a freelist page", pgid)
+		}
+
+		count := int(binary.LittleEndian.Uint16(buf[21:23]))
+		if count > freelistPageIDs {
+			return fmt.Errorf("freelist page %d is corrupted", pgid)
+		}
+
+		chain = append(chain, pgid)
+		for i := 0; i < count; i++ {
+			offset := freelistHeaderSize + i*8
+			freelist = append(freelist, binary.LittleEndian.Uint64(buf[offset:offset+8]))
+		}
+
+		pgid = binary.LittleEndian.Uint64(buf[13:21])
+	}
+
+	sort.Slice(freelist, func(i, j int) bool { return freelist[i] < freelist[j] })
+	db.meta.freelist = freelist
+	db.meta.chain = chain
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package kvdb
+
+// Hooks are called on events inside the database. they run in the goroutine
+// of the transaction while it holds its lock, so they must be fast and must
+// not use the database. only OnCommit and OnRollback run after the lock is
+// released. embed NopHooks to implement only some of them
+type Hooks interface {
+	// OnSplit is called after a full node was split, the keys after the
+	// split point moved to the new sibling
+	OnSplit(bucket string, pgid uint64, sibling uint64)
+	// OnMerge is called when a node is removed from its parent, because it
+	// was left without keys or DeleteRange removed its whole subtree. nodes
+	// are not rebalanced, so only those nodes are merged away
+	OnMerge(bucket string, pgid uint64, parent uint64)
+	// OnPageAlloc is called when a page is taken for a new node or the
+	// pages holding the freelist
+	OnPageAlloc(pgid uint64)
+	// OnPageFree is called when a page is given back to the freelist
+	OnPageFree(pgid uint64)
+	// OnCommit is called after a transaction was committed and synced with
+	// the pages of the nodes it wrote, in order
+	OnCommit(txid uint64, dirtyPages []uint64)
+	// OnRollback is called after a writable transaction was rolled back
+	OnRollback(txid uint64)
+}
+
+// NopHooks implements Hooks doing nothing
+type NopHooks struct{}
+
+func (NopHooks) OnSplit(bucket string, pgid uint64, sibling uint64) {}
+func (NopHooks) OnMerge(bucket string, pgid uint64, parent uint64)  {}
+func (NopHooks) OnPageAlloc(pgid uint64)                            {}
+func (NopHooks) OnPageFree(pgid uint64)                             {}
+func (NopHooks) OnCommit(txid uint64, dirtyPages []uint64)          {}
+func (NopHooks) OnRollback(txid uint64)                             {}
@@ -0,0 +1,189 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// recordHooks records every event as text
+type recordHooks struct {
+	events []string
+}
+
+func (h *recordHooks) OnSplit(bucket string, pgid uint64, sibling uint64) {
+	h.events = append(h.events, fmt.Sprintf("split %s %d %d", bucket, pgid, sibling))
+}
+
+func (h *recordHooks) OnMerge(bucket string, pgid uint64, parent uint64) {
+	h.events = append(h.events, fmt.Sprintf("merge %s %d %d", bucket, pgid, parent))
+}
+
+func (h *recordHooks) OnPageAlloc(pgid uint64) {
+	h.events = append(h.events, fmt.Sprintf("alloc %d", pgid))
+}
+
+func (h *recordHooks) OnPageFree(pgid uint64) {
+	h.events = append(h.events, fmt.Sprintf("free %d", pgid))
+}
+
+func (h *recordHooks) OnCommit(txid uint64, dirtyPages []uint64) {
+	h.events = append(h.events, fmt.Sprintf("commit %d %v", txid, dirtyPages))
+}
+
+func (h *recordHooks) OnRollback(txid uint64) {
+	h.events = append(h.events, fmt.Sprintf("rollback %d", txid))
+}
+
+func TestHooks(t *testing.T) {
+	path := tempDBPath(t)
+	hooks := &recordHooks{}
+	db, err := Open(path, &Config{maxKeysPerNode: 2, Hooks: hooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "users")
+	for _, name := range []string{"Ahmed", "Basem", "Camal"} {
+		if err := bucket.Put([]byte(name), []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{
+		// the bucket is created with its root leaf
+		"alloc 1",
+		"commit 1 [1]",
+		// commits move the leaf to a new page, the old one is free once
+		// the commit is done. the freelist is stored in a page of its own,
+		// replaced by every commit
+		"alloc 2",
+		"free 1",
+		"alloc 3",
+		"commit 2 [2]",
+		"alloc 1",
+		"free 2",
+		"alloc 4",
+		"free 3",
+		"commit 3 [1]",
+		// the third key splits the root leaf, a new root takes page 2
+		"alloc 2",
+		"alloc 3",
+		"split users 1 3",
+		"alloc 5",
+		"free 1",
+		"alloc 6",
+		"free 4",
+		"commit 4 [2 3 5]",
+	}
+	if fmt.Sprint(hooks.events) != fmt.Sprint(expected) {
+		t.Fatalf("expected events %v but got %v", expected, hooks.events)
+	}
+
+	hooks.events = nil
+	if err := bucket.Delete([]byte("Camal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Delete([]byte("Basem")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []string{
+		// the leaf and the root are moved
+		"alloc 1",
+		"free 3",
+		"alloc 4",
+		"free 2",
+		"alloc 7",
+		"free 6",
+		"commit 5 [1 4]",
+		// the emptied leaf is freed and the root moved again
+		"free 1",
+		"merge users 1 4",
+		"alloc 2",
+		"free 4",
+		"alloc 3",
+		"free 7",
+		"commit 6 [2]",
+	}
+	if fmt.Sprint(hooks.events) != fmt.Sprint(expected) {
+		t.Fatalf("expected events %v but got %v", expected, hooks.events)
+	}
+
+	hooks.events = nil
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx *Tx) error {
+		if tx.ID() != 7 {
+			t.Fatalf("expected writable tx id 7 but got %d", tx.ID())
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("expected abort error but got %v", err)
+	}
+
+	if fmt.Sprint(hooks.events) != fmt.Sprint([]string{"rollback 7"}) {
+		t.Fatalf("expected a rollback event but got %v", hooks.events)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the id of the last committed transaction survives reopening the file
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	err = db.View(func(tx *Tx) error {
+		if tx.ID() != 6 {
+			t.Fatalf("expected read-only tx id 6 but got %d", tx.ID())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHooksDeleteRange(t *testing.T) {
+	hooks := &recordHooks{}
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2, Hooks: hooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "users")
+	for _, name := range []string{"Ahmed", "Basem", "Camal", "Dina", "Emad", "Fady"} {
+		if err := bucket.Put([]byte(name), []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every child removed from a parent is reported, whether it was emptied
+	// key by key or released with its whole subtree
+	hooks.events = nil
+	if _, err := bucket.DeleteRange([]byte("B"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	frees, merges := 0, 0
+	for _, event := range hooks.events {
+		var kind string
+		fmt.Sscan(event, &kind)
+		switch kind {
+		case "free":
+			frees++
+		case "merge":
+			merges++
+		}
+	}
+	if frees == 0 || merges == 0 {
+		t.Fatalf("expected pages to be freed and merged but got %v", hooks.events)
+	}
+}
@@ -0,0 +1,375 @@
+// Package httpapi serves a kvdb database over HTTP
+//
+//	GET    /buckets                      names of the buckets
+//	GET    /buckets/{bucket}/keys        keys and values in order, see below
+//	GET    /buckets/{bucket}/keys/{key}  value of the key
+//	PUT    /buckets/{bucket}/keys/{key}  write the value of the key
+//	DELETE /buckets/{bucket}/keys/{key}  delete the key
+//	POST   /tx                           apply writes atomically
+//
+// values are sent and returned as raw bytes, or as JSON when the request
+// has the application/json content type or accepts application/json. keys
+// and values in JSON are base64 strings, so any bytes can be used. keys in
+// paths and query strings are URL escaped.
+//
+// listing keys takes the query parameters
+//
+//	prefix   only keys starting with prefix
+//	start    first key, included
+//	end      key to stop at, excluded
+//	limit    maximum number of keys, 100 by default and at most 1000
+//	reverse  list the keys from the last one when true
+//
+// and returns {"items": [{"key": ..., "value": ...}], "next": ...}. next is
+// set when there are more keys, pass it as start to get the next page, or as
+// end when listing in reverse
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"ahmedash95/kvdb"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+
+	// maxBodySize is the largest request body read, values are stored in
+	// pages so they are much smaller anyway
+	maxBodySize = 16 << 20
+)
+
+type handler struct {
+	db *kvdb.DB
+}
+
+// Handler returns an http.Handler serving db
+func Handler(db *kvdb.DB) http.Handler {
+	return &handler{db: db}
+}
+
+// Item is a key and its value
+type Item struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// List is the answer to listing keys
+type List struct {
+	Items []Item `json:"items"`
+	Next  []byte `json:"next,omitempty"`
+}
+
+// Op is a write of a transaction posted to /tx. Op is put, delete or
+// delete_range, delete_range removes the keys in [Key, End)
+type Op struct {
+	Op     string `json:"op"`
+	Bucket string `json:"bucket"`
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	End    []byte `json:"end,omitempty"`
+}
+
+// Tx is the body posted to /tx. the writes are applied in order, all of
+// them or none
+type Tx struct {
+	Ops []Op `json:"ops"`
+}
+
+// httpError is an error with the status code it is answered with
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func errorf(status int, format string, args ...any) error {
+	return &httpError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.route(w, r); err != nil {
+		status := http.StatusInternalServerError
+		var herr *httpError
+		if errors.As(err, &herr) {
+			status = herr.status
+		} else if errors.Is(err, kvdb.ErrKeyNotFound) {
+			status = http.StatusNotFound
+		}
+
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+	}
+}
+
+func (h *handler) route(w http.ResponseWriter, r *http.Request) error {
+	// split the escaped path so keys can hold slashes
+	var parts []string
+	for _, part := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		part, err := url.PathUnescape(part)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "invalid path: %v", err)
+		}
+		parts = append(parts, part)
+	}
+
+	// names starting with a zero byte are kept by the database for itself
+	if len(parts) > 1 && parts[0] == "buckets" && !validBucket(parts[1]) {
+		return errorf(http.StatusBadRequest, "invalid bucket name %q", parts[1])
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "buckets":
+		if r.Method != http.MethodGet {
+			return methodNotAllowed(w, http.MethodGet)
+		}
+		return h.buckets(w, r)
+	case len(parts) == 1 && parts[0] == "tx":
+		if r.Method != http.MethodPost {
+			return methodNotAllowed(w, http.MethodPost)
+		}
+		return h.tx(w, r)
+	case len(parts) == 3 && parts[0] == "buckets" && parts[2] == "keys":
+		if r.Method != http.MethodGet {
+			return methodNotAllowed(w, http.MethodGet)
+		}
+		return h.list(w, r, parts[1])
+	case len(parts) == 4 && parts[0] == "buckets" && parts[2] == "keys":
+		switch r.Method {
+		case http.MethodGet:
+			return h.get(w, r, parts[1], []byte(parts[3]))
+		case http.MethodPut:
+			return h.put(w, r, parts[1], []byte(parts[3]))
+		case http.MethodDelete:
+			return h.delete(w, r, parts[1], []byte(parts[3]))
+		}
+		return methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+
+	return errorf(http.StatusNotFound, "%s not found", r.URL.Path)
+}
+
+func methodNotAllowed(w http.ResponseWriter, methods ...string) error {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	return errorf(http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func (h *handler) buckets(w http.ResponseWriter, r *http.Request) error {
+	writeJSON(w, http.StatusOK, h.db.Buckets())
+	return nil
+}
+
+// view runs fn with the named bucket in a read-only transaction, a bucket
+// that does not exist is not found
+func (h *handler) view(name string, fn func(b *kvdb.Bucket) error) error {
+	return h.db.View(func(tx *kvdb.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return errorf(http.StatusNotFound, "bucket %s not found", name)
+		}
+
+		return fn(b)
+	})
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request, bucket string, key []byte) error {
+	var value []byte
+	err := h.view(bucket, func(b *kvdb.Bucket) error {
+		v, err := b.Get(key)
+
+		// the value belongs to the node, copy it before the transaction ends
+		value = append([]byte{}, v...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if acceptsJSON(r) {
+		writeJSON(w, http.StatusOK, Item{Key: key, Value: value})
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+
+	return nil
+}
+
+// put writes the body as the value, or the value of the Item in a JSON body.
+// the ttl query parameter, like 30s or 1h, makes the key expire
+func (h *handler) put(w http.ResponseWriter, r *http.Request, bucket string, key []byte) error {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		return errorf(http.StatusBadRequest, "reading the body: %v", err)
+	}
+
+	value := body
+	if isJSON(r) {
+		var item Item
+		if err := json.Unmarshal(body, &item); err != nil {
+			return errorf(http.StatusBadRequest, "invalid JSON: %v", err)
+		}
+		value = item.Value
+	}
+
+	var ttl time.Duration
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 {
+			return errorf(http.StatusBadRequest, "invalid ttl %q", s)
+		}
+	}
+
+	err = h.db.Update(func(tx *kvdb.Tx) error {
+		if ttl > 0 {
+			return tx.Bucket(bucket).PutWithTTL(key, value, ttl)
+		}
+		return tx.Bucket(bucket).Put(key, value)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request, bucket string, key []byte) error {
+	// do not create the bucket just to find out the key is not there
+	if err := h.view(bucket, func(b *kvdb.Bucket) error { return nil }); err != nil {
+		return err
+	}
+
+	err := h.db.Update(func(tx *kvdb.Tx) error {
+		return tx.Bucket(bucket).Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request, bucket string) error {
+	query := r.URL.Query()
+
+	prefix := []byte(query.Get("prefix"))
+	start := []byte(query.Get("start"))
+	end := []byte(query.Get("end"))
+
+	limit := defaultLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxLimit {
+			return errorf(http.StatusBadRequest, "limit must be between 1 and %d", maxLimit)
+		}
+		limit = n
+	}
+
+	reverse := false
+	if s := query.Get("reverse"); s != "" {
+		var err error
+		if reverse, err = strconv.ParseBool(s); err != nil {
+			return errorf(http.StatusBadRequest, "invalid reverse %q", s)
+		}
+	}
+
+	list := List{Items: []Item{}}
+	err := h.view(bucket, func(b *kvdb.Bucket) error {
+		scan := b.ScanPrefixRange
+		if reverse {
+			scan = b.ScanPrefixRangeReverse
+		}
+
+		return scan(prefix, start, end, func(key []byte, value []byte) bool {
+			// one more key means there is a next page, it starts at that key,
+			// or ends after the last key returned when listing in reverse
+			if len(list.Items) == limit {
+				list.Next = append([]byte{}, key...)
+				if reverse {
+					list.Next = list.Items[len(list.Items)-1].Key
+				}
+				return false
+			}
+
+			list.Items = append(list.Items, Item{Key: append([]byte{}, key...), Value: append([]byte{}, value...)})
+			return true
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, list)
+	return nil
+}
+
+// tx applies the writes of the posted Tx with DB.Write
+func (h *handler) tx(w http.ResponseWriter, r *http.Request) error {
+	var body Tx
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&body); err != nil {
+		return errorf(http.StatusBadRequest, "invalid JSON: %v", err)
+	}
+
+	var wb kvdb.WriteBatch
+	for i, op := range body.Ops {
+		if !validBucket(op.Bucket) {
+			return errorf(http.StatusBadRequest, "op %d: invalid bucket name %q", i, op.Bucket)
+		}
+
+		switch op.Op {
+		case "put":
+			wb.Put(op.Bucket, op.Key, op.Value)
+		case "delete":
+			wb.Delete(op.Bucket, op.Key)
+		case "delete_range":
+			wb.DeleteRange(op.Bucket, op.Key, op.End)
+		default:
+			return errorf(http.StatusBadRequest, "op %d: unknown op %q", i, op.Op)
+		}
+	}
+
+	if err := h.db.Write(&wb); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func validBucket(name string) bool {
+	return name != "" && name[0] != 0
+}
+
+func isJSON(r *http.Request) bool {
+	typ, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return typ == "application/json"
+}
+
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if typ, _, _ := mime.ParseMediaType(strings.TrimSpace(accept)); typ == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
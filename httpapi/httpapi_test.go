@@ -0,0 +1,273 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"ahmedash95/kvdb"
+)
+
+func startServer(t *testing.T) (*kvdb.DB, *httptest.Server) {
+	db, err := kvdb.Open(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(Handler(db))
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+	})
+
+	return db, server
+}
+
+// do sends a request and returns the status and body of the response
+func do(t *testing.T, method string, url string, contentType string, body string) (int, string) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", contentType)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, string(data)
+}
+
+// mustBucket returns a handle of the named bucket, creating it
+func mustBucket(t *testing.T, db *kvdb.DB, name string) *kvdb.Bucket {
+	t.Helper()
+
+	bucket, err := db.Bucket(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bucket
+}
+
+func TestHandlerKeys(t *testing.T) {
+	db, server := startServer(t)
+
+	key := server.URL + "/buckets/users/keys/" + url.PathEscape("user/1")
+
+	if status, _ := do(t, "GET", key, "", ""); status != http.StatusNotFound {
+		t.Fatalf("expected a missing bucket to be not found but got %d", status)
+	}
+
+	if status, body := do(t, "PUT", key, "", "\x00ahmed"); status != http.StatusNoContent {
+		t.Fatalf("expected the put to succeed but got %d %s", status, body)
+	}
+	if status, body := do(t, "GET", key, "", ""); status != http.StatusOK || body != "\x00ahmed" {
+		t.Fatalf("expected the raw value but got %d %q", status, body)
+	}
+
+	// keys can hold slashes
+	value, err := mustBucket(t, db, "users").Get([]byte("user/1"))
+	if err != nil || string(value) != "\x00ahmed" {
+		t.Fatalf("expected the value under user/1 but got %q %v", value, err)
+	}
+
+	// values are base64 in JSON
+	if status, body := do(t, "PUT", key, "application/json", `{"value":"c2FyYQ=="}`); status != http.StatusNoContent {
+		t.Fatalf("expected the put to succeed but got %d %s", status, body)
+	}
+	status, body := do(t, "GET", key, "application/json", "")
+	if status != http.StatusOK || body != `{"key":"dXNlci8x","value":"c2FyYQ=="}`+"\n" {
+		t.Fatalf("expected the JSON item but got %d %s", status, body)
+	}
+
+	if status, body := do(t, "PUT", key, "application/json", `{"value":`); status != http.StatusBadRequest {
+		t.Fatalf("expected invalid JSON to be rejected but got %d %s", status, body)
+	}
+	if status, _ := do(t, "POST", key, "", ""); status != http.StatusMethodNotAllowed {
+		t.Fatalf("expected POST to not be allowed but got %d", status)
+	}
+
+	if status, _ := do(t, "DELETE", key, "", ""); status != http.StatusNoContent {
+		t.Fatalf("expected the delete to succeed but got %d", status)
+	}
+	if status, _ := do(t, "DELETE", key, "", ""); status != http.StatusNotFound {
+		t.Fatalf("expected a deleted key to be not found but got %d", status)
+	}
+
+	if status, body := do(t, "GET", server.URL+"/buckets", "", ""); status != http.StatusOK || body != `["users"]`+"\n" {
+		t.Fatalf("expected the users bucket but got %d %s", status, body)
+	}
+
+	if status, _ := do(t, "GET", server.URL+"/buckets/"+url.PathEscape("\x00ttl:users")+"/keys", "", ""); status != http.StatusBadRequest {
+		t.Fatalf("expected internal buckets to be rejected but got %d", status)
+	}
+}
+
+func TestHandlerList(t *testing.T) {
+	db, server := startServer(t)
+
+	bucket := mustBucket(t, db, "users")
+	for i := 0; i < 25; i++ {
+		if err := bucket.Put([]byte(fmt.Sprintf("user:%02d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bucket.Put([]byte("order:1"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	// list reads every page of keys and returns them in the order received
+	list := func(query url.Values, reverse bool) []string {
+		var keys []string
+		for {
+			status, body := do(t, "GET", server.URL+"/buckets/users/keys?"+query.Encode(), "", "")
+			if status != http.StatusOK {
+				t.Fatalf("expected the keys but got %d %s", status, body)
+			}
+
+			var page List
+			if err := json.Unmarshal([]byte(body), &page); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, item := range page.Items {
+				keys = append(keys, string(item.Key))
+			}
+			if page.Next == nil {
+				return keys
+			}
+
+			if reverse {
+				query.Set("end", string(page.Next))
+			} else {
+				query.Set("start", string(page.Next))
+			}
+		}
+	}
+
+	keys := list(url.Values{"prefix": {"user:"}, "limit": {"10"}}, false)
+	if len(keys) != 25 || keys[0] != "user:00" || keys[24] != "user:24" {
+		t.Fatalf("expected the 25 user keys in order but got %v", keys)
+	}
+
+	keys = list(url.Values{"prefix": {"user:"}, "limit": {"10"}, "reverse": {"true"}}, true)
+	if len(keys) != 25 || keys[0] != "user:24" || keys[24] != "user:00" {
+		t.Fatalf("expected the 25 user keys in reverse order but got %v", keys)
+	}
+
+	keys = list(url.Values{"start": {"user:20"}, "end": {"user:23"}}, false)
+	if fmt.Sprint(keys) != "[user:20 user:21 user:22]" {
+		t.Fatalf("expected the keys in [user:20, user:23) but got %v", keys)
+	}
+
+	if status, _ := do(t, "GET", server.URL+"/buckets/users/keys?limit=5000", "", ""); status != http.StatusBadRequest {
+		t.Fatalf("expected a too large limit to be rejected but got %d", status)
+	}
+}
+
+func TestHandlerListComparator(t *testing.T) {
+	db, err := kvdb.Open(filepath.Join(t.TempDir(), "test.db"), &kvdb.Config{
+		Comparators: map[string]kvdb.Comparator{"users": kvdb.ReverseComparator},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	server := httptest.NewServer(Handler(db))
+	defer server.Close()
+
+	bucket := mustBucket(t, db, "users")
+	for _, key := range []string{"a", "user:1", "user:2", "user:3", "z"} {
+		if err := bucket.Put([]byte(key), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pages of the prefix follow the order of the bucket
+	var keys []string
+	query := url.Values{"prefix": {"user:"}, "limit": {"2"}}
+	for {
+		status, body := do(t, "GET", server.URL+"/buckets/users/keys?"+query.Encode(), "", "")
+		if status != http.StatusOK {
+			t.Fatalf("expected the keys but got %d %s", status, body)
+		}
+
+		var page List
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, item := range page.Items {
+			keys = append(keys, string(item.Key))
+		}
+		if page.Next == nil {
+			break
+		}
+		query.Set("start", string(page.Next))
+	}
+
+	if fmt.Sprint(keys) != "[user:3 user:2 user:1]" {
+		t.Fatalf("expected the user keys in reverse byte order but got %v", keys)
+	}
+}
+
+func TestHandlerTx(t *testing.T) {
+	db, server := startServer(t)
+
+	if err := mustBucket(t, db, "users").Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := `{"ops": [
+		{"op": "put", "bucket": "users", "key": "Yg==", "value": "Mg=="},
+		{"op": "delete", "bucket": "users", "key": "YQ=="},
+		{"op": "put", "bucket": "orders", "key": "bw==", "value": "Mw=="}
+	]}`
+	if status, body := do(t, "POST", server.URL+"/tx", "application/json", tx); status != http.StatusNoContent {
+		t.Fatalf("expected the tx to succeed but got %d %s", status, body)
+	}
+
+	if _, err := mustBucket(t, db, "users").Get([]byte("a")); err == nil {
+		t.Fatal("expected a to be deleted")
+	}
+	if value, err := mustBucket(t, db, "orders").Get([]byte("o")); err != nil || string(value) != "3" {
+		t.Fatalf("expected o to be 3 but got %q %v", value, err)
+	}
+
+	// the delete of a missing key fails the whole tx
+	tx = `{"ops": [
+		{"op": "put", "bucket": "users", "key": "Yw==", "value": "Mg=="},
+		{"op": "delete", "bucket": "users", "key": "YQ=="}
+	]}`
+	if status, body := do(t, "POST", server.URL+"/tx", "application/json", tx); status != http.StatusNotFound {
+		t.Fatalf("expected the tx to fail but got %d %s", status, body)
+	}
+	if _, err := mustBucket(t, db, "users").Get([]byte("c")); err == nil {
+		t.Fatal("expected c to not be written")
+	}
+
+	tx = `{"ops": [{"op": "rename", "bucket": "users", "key": "YQ=="}]}`
+	if status, body := do(t, "POST", server.URL+"/tx", "application/json", tx); status != http.StatusBadRequest {
+		t.Fatalf("expected an unknown op to be rejected but got %d %s", status, body)
+	}
+}
@@ -0,0 +1,234 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrIndexNotFound is returned when reading an index that was not created
+// since the database was opened
+var ErrIndexNotFound = errors.New("index not found")
+
+// IndexFunc returns the index keys of a value, none if the value is not
+// indexed. it must return the same keys every time it is given the value.
+// it is never called with an empty value, those are not indexed
+type IndexFunc func(value []byte) [][]byte
+
+// every index of a bucket has an internal bucket
+//
+//	index bucket: index key + primary key -> nothing
+//
+// the keys are encoded like PairKey, so the primary keys of an index key are
+// next to each other and index keys are in order
+
+var indexKeyCodec = PairKey[[]byte, []byte]{BytesKey{}, BytesKey{}}
+
+const indexBucketPrefix = internalBucketPrefix + "index:"
+
+func indexBucketName(bucket string, name string) string {
+	return indexBucketPrefix + bucket + ":" + name
+}
+
+func encodeIndexEntry(indexKey []byte, key []byte) []byte {
+	entry, _ := indexKeyCodec.Encode(Pair[[]byte, []byte]{indexKey, key})
+	return entry
+}
+
+// CreateIndex maintains the named index of the bucket with fn on every
+// change. the index is built again from every value of the bucket, and
+// indexes are not kept across restarts, CreateIndex must be called again
+// after every Open before the index is read
+func (b *Bucket) CreateIndex(name string, fn IndexFunc) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("invalid index name %q", name)
+	}
+
+	return b.update(func(b *Bucket) error {
+		// the bucket may have changed while the index was not maintained
+		index := b.tx.Bucket(indexBucketName(b.name, name))
+		index.deleteRange(nil, nil)
+
+		var err error
+		b.node(b.root).scan(func(key []byte, value []byte) bool {
+			if len(value) == 0 {
+				return true
+			}
+			for _, indexKey := range fn(value) {
+				entry := encodeIndexEntry(indexKey, key)
+				if len(entry) > MaxKeySize {
+					err = fmt.Errorf("index %s of key %q: %w", name, key, ErrKeyTooLarge)
+					return false
+				}
+				index.put(entry, nil)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		b.setIndex(name, fn)
+
+		return nil
+	})
+}
+
+// checkIndexSize returns ErrKeyTooLarge if an index entry of key and value
+// is longer than a key may be
+func (b *Bucket) checkIndexSize(key []byte, value []byte) error {
+	b.mu.Lock()
+	indexes := b.indexes
+	b.mu.Unlock()
+
+	if len(value) == 0 {
+		return nil
+	}
+
+	for _, fn := range indexes {
+		for _, indexKey := range fn(value) {
+			if len(encodeIndexEntry(indexKey, key)) > MaxKeySize {
+				return ErrKeyTooLarge
+			}
+		}
+	}
+
+	return nil
+}
+
+// setIndex adds the index to the bucket, the transaction keeps the indexes
+// the bucket had so a rollback restores them
+func (b *Bucket) setIndex(name string, fn IndexFunc) {
+	if _, ok := b.tx.indexes[b.bucket]; !ok {
+		if b.tx.indexes == nil {
+			b.tx.indexes = make(map[*bucket]map[string]IndexFunc)
+		}
+		b.tx.indexes[b.bucket] = b.indexes
+	}
+
+	indexes := make(map[string]IndexFunc, len(b.indexes)+1)
+	for name, fn := range b.indexes {
+		indexes[name] = fn
+	}
+	indexes[name] = fn
+
+	b.mu.Lock()
+	b.indexes = indexes
+	b.mu.Unlock()
+}
+
+// updateIndexes moves the index entries of key from the index keys of
+// before to the ones of after
+func (b *Bucket) updateIndexes(typ EventType, key []byte, before []byte, after []byte) {
+	for name, fn := range b.indexes {
+		index := b.tx.Bucket(indexBucketName(b.name, name))
+
+		// before is nil for a new key, empty values have no entries
+		if len(before) > 0 {
+			for _, indexKey := range fn(before) {
+				index.delete(encodeIndexEntry(indexKey, key))
+			}
+		}
+
+		if typ == EventPut && len(after) > 0 {
+			for _, indexKey := range fn(after) {
+				index.put(encodeIndexEntry(indexKey, key), nil)
+			}
+		}
+	}
+}
+
+// Index is a handle of an index of a bucket
+type Index struct {
+	bucket *Bucket
+	name   string
+}
+
+// Index returns a handle of the named index. reading the index fails with
+// ErrIndexNotFound if it was not created with CreateIndex
+func (b *Bucket) Index(name string) *Index {
+	return &Index{bucket: b, name: name}
+}
+
+// view runs fn with the bucket and the bucket of the index
+func (i *Index) view(fn func(b *Bucket, index *Bucket) error) error {
+	return i.bucket.view(func(b *Bucket) error {
+		b.mu.Lock()
+		_, ok := b.indexes[i.name]
+		b.mu.Unlock()
+		if !ok {
+			return ErrIndexNotFound
+		}
+
+		index := b.tx.bucket(indexBucketName(b.name, i.name), false)
+		if index == nil {
+			return ErrIndexNotFound
+		}
+
+		return fn(b, index)
+	})
+}
+
+// Get returns the key and value of the first key, in key order, indexed
+// under indexKey. it returns ErrKeyNotFound if there is none
+func (i *Index) Get(indexKey []byte) ([]byte, []byte, error) {
+	var key, value []byte
+	found := false
+	err := i.Scan(indexKey, func(k []byte, v []byte) bool {
+		key, value, found = k, v, true
+		return false
+	})
+	if err == nil && !found {
+		err = ErrKeyNotFound
+	}
+
+	return key, value, err
+}
+
+// Scan calls f with the key and value of every key indexed under indexKey
+// in key order until f returns false
+func (i *Index) Scan(indexKey []byte, f func(key []byte, value []byte) bool) error {
+	start := encodeIndexEntry(indexKey, nil)
+
+	return i.scan(start, prefixEnd(start), func(indexKey []byte, key []byte, value []byte) bool {
+		return f(key, value)
+	})
+}
+
+// ScanRange calls f with the index key, key and value of every key indexed
+// under an index key in [start, end), in index key order, until f returns
+// false. an empty start or end leaves the range open on that side
+func (i *Index) ScanRange(start []byte, end []byte, f func(indexKey []byte, key []byte, value []byte) bool) error {
+	var startEntry, endEntry []byte
+	if len(start) > 0 {
+		startEntry = encodeIndexEntry(start, nil)
+	}
+	if len(end) > 0 {
+		endEntry = encodeIndexEntry(end, nil)
+	}
+
+	return i.scan(startEntry, endEntry, f)
+}
+
+// scan calls f for the entries of the index in [start, end)
+func (i *Index) scan(start []byte, end []byte, f func(indexKey []byte, key []byte, value []byte) bool) error {
+	return i.view(func(b *Bucket, index *Bucket) error {
+		var err error
+		index.node(index.root).scanRange(start, end, func(entry []byte, _ []byte) bool {
+			var pair Pair[[]byte, []byte]
+			if pair, err = indexKeyCodec.Decode(entry); err != nil {
+				return false
+			}
+
+			// skip keys that expired but were not swept yet
+			value, ok := b.lookup(pair.Second)
+			if !ok || b.expired(pair.Second) {
+				return true
+			}
+
+			return f(pair.First, pair.Second, value)
+		})
+
+		return err
+	})
+}
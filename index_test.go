@@ -0,0 +1,269 @@
+package kvdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type account struct {
+	Email string
+	Tags  []string
+}
+
+func accountValue(t *testing.T, email string, tags ...string) []byte {
+	value, err := json.Marshal(account{Email: email, Tags: tags})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func indexEmail(value []byte) [][]byte {
+	var a account
+	if err := json.Unmarshal(value, &a); err != nil || a.Email == "" {
+		return nil
+	}
+
+	return [][]byte{[]byte(a.Email)}
+}
+
+func indexTags(value []byte) [][]byte {
+	var a account
+	if err := json.Unmarshal(value, &a); err != nil {
+		return nil
+	}
+
+	var keys [][]byte
+	for _, tag := range a.Tags {
+		keys = append(keys, []byte(tag))
+	}
+	return keys
+}
+
+// indexKeys returns the keys indexed under indexKey
+func indexKeys(t *testing.T, index *Index, indexKey string) []string {
+	t.Helper()
+
+	var keys []string
+	err := index.Scan([]byte(indexKey), func(key []byte, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestIndex(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := mustBucket(t, db, "accounts")
+	if err := accounts.Put([]byte("1"), accountValue(t, "ahmed@example.com", "admin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Put([]byte("0"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := accounts.Index("email").Get([]byte("ahmed@example.com")); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected ErrIndexNotFound but got %v", err)
+	}
+	if err := accounts.CreateIndex("by:email", indexEmail); err == nil {
+		t.Fatal("expected an index name with a colon to be rejected")
+	}
+
+	// existing values are indexed
+	if err := accounts.CreateIndex("email", indexEmail); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.CreateIndex("tags", indexTags); err != nil {
+		t.Fatal(err)
+	}
+
+	emails := accounts.Index("email")
+	key, value, err := emails.Get([]byte("ahmed@example.com"))
+	if err != nil || string(key) != "1" || string(value) != string(accountValue(t, "ahmed@example.com", "admin")) {
+		t.Fatalf("expected account 1 but got %q %q %v", key, value, err)
+	}
+
+	for i := 2; i <= 5; i++ {
+		value := accountValue(t, fmt.Sprintf("user%d@example.com", i), "user", fmt.Sprintf("group%d", i%2))
+		if err := accounts.Put([]byte(fmt.Sprint(i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the index functions are only given values, empty ones are not indexed
+	if err := accounts.CreateIndex("first", func(value []byte) [][]byte {
+		return [][]byte{value[:1]}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Put([]byte("7"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Put([]byte("8"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Delete([]byte("8")); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Delete([]byte("7")); err != nil {
+		t.Fatal(err)
+	}
+
+	tags := accounts.Index("tags")
+	if keys := indexKeys(t, tags, "group0"); fmt.Sprint(keys) != "[2 4]" {
+		t.Fatalf("expected accounts 2 and 4 but got %v", keys)
+	}
+
+	// an update moves the entries of the key
+	if err := accounts.Update([]byte("2"), accountValue(t, "two@example.com", "user")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := emails.Get([]byte("user2@example.com")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected the old email to be gone but got %v", err)
+	}
+	if keys := indexKeys(t, emails, "two@example.com"); fmt.Sprint(keys) != "[2]" {
+		t.Fatalf("expected account 2 but got %v", keys)
+	}
+	if keys := indexKeys(t, tags, "group0"); fmt.Sprint(keys) != "[4]" {
+		t.Fatalf("expected account 4 but got %v", keys)
+	}
+
+	if err := accounts.Delete([]byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accounts.DeleteRange([]byte("5"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if keys := indexKeys(t, tags, "user"); fmt.Sprint(keys) != "[2 3]" {
+		t.Fatalf("expected accounts 2 and 3 but got %v", keys)
+	}
+
+	var entries []string
+	err = emails.ScanRange([]byte("t"), nil, func(indexKey []byte, key []byte, value []byte) bool {
+		entries = append(entries, string(indexKey)+"="+string(key))
+		return true
+	})
+	if err != nil || fmt.Sprint(entries) != "[two@example.com=2 user3@example.com=3]" {
+		t.Fatalf("expected the emails from t but got %v %v", entries, err)
+	}
+
+	// the index changes with the transaction that changes the bucket
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Bucket("accounts").Put([]byte("6"), accountValue(t, "six@example.com")); err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err == nil {
+		t.Fatal("expected the transaction to fail")
+	}
+	if _, _, err := emails.Get([]byte("six@example.com")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected the rolled back email to be missing but got %v", err)
+	}
+
+	// a rolled back index is not maintained
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Bucket("accounts").CreateIndex("tmp", indexEmail); err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err == nil {
+		t.Fatal("expected the transaction to fail")
+	}
+	if _, _, err := accounts.Index("tmp").Get([]byte("two@example.com")); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected ErrIndexNotFound but got %v", err)
+	}
+
+	if problems := db.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems but got %v", problems)
+	}
+	if strings.Contains(fmt.Sprint(db.Buckets()), "index") {
+		t.Fatalf("expected index buckets to be hidden but got %v", db.Buckets())
+	}
+
+	db.Close()
+
+	// indexes are created again after reopening, catching up with the
+	// changes made in between
+	db, err = Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	accounts = mustBucket(t, db, "accounts")
+	if _, _, err := accounts.Index("email").Get([]byte("two@example.com")); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected ErrIndexNotFound but got %v", err)
+	}
+	if err := accounts.Delete([]byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.CreateIndex("email", indexEmail); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := accounts.Index("email").Get([]byte("two@example.com")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected the deleted account to be missing but got %v", err)
+	}
+	if keys := indexKeys(t, accounts.Index("email"), "user3@example.com"); fmt.Sprint(keys) != "[3]" {
+		t.Fatalf("expected account 3 but got %v", keys)
+	}
+}
+
+func TestIndexKeyTooLarge(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// the key fits on its own, not with the index key before it
+	email := strings.Repeat("a", MaxKeySize-10) + "@example.com"
+	key := []byte(strings.Repeat("k", 20))
+
+	accounts := mustBucket(t, db, "accounts")
+	if err := accounts.Put(key, accountValue(t, email)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := accounts.CreateIndex("email", indexEmail); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge from building the index but got %v", err)
+	}
+	if err := accounts.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := accounts.CreateIndex("email", indexEmail); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Put(key, accountValue(t, email)); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge from Put but got %v", err)
+	}
+	if err := accounts.Put([]byte("1"), accountValue(t, "ahmed@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := accounts.Update([]byte("1"), accountValue(t, email)); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected ErrKeyTooLarge from Update but got %v", err)
+	}
+
+	if keys := indexKeys(t, accounts.Index("email"), "ahmed@example.com"); fmt.Sprint(keys) != "[1]" {
+		t.Fatalf("expected the index to keep key 1 but got %v", keys)
+	}
+	if problems := db.Check(); len(problems) > 0 {
+		t.Fatalf("unexpected problems %v", problems)
+	}
+}
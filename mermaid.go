@@ -43,7 +43,7 @@ func MermaidNode(n *Node, oldPrefix, prefix string) string {
 
 	if n.typ == NODE_TYPE_INTERNAL {
 		for _, child := range n.children {
-			childNode := n.bucket.node(child)
+			childNode := n.child(child)
 			if len(childNode.Keys) == 0 { // debug only - should never happen
 				panic(fmt.Sprintf("childNode.Keys is empty: %v", child))
 			}
@@ -2,124 +2,268 @@ package kvdb
 
 import (
 	"encoding/binary"
-	"strings"
+	"errors"
+	"fmt"
 	"sync"
 )
 
 type Meta struct {
-	buckets []*MetaRecord
-	pgid    uint64
-	mu      sync.Mutex
+	buckets      []*MetaRecord
+	pgid         uint64
+	freelist     []uint64 // sorted ids of free pages
+	freelistPage uint64   // first page of the freelist chain
+	chain        []uint64 // pages of the freelist chain, free once another chain is committed
+	txid         uint64   // id of the last committed transaction
+	mu           sync.Mutex
+
+	// pages freed and allocated by the writable transaction. freed pages
+	// are still used by the file until the transaction commits, allocated
+	// ones are not used by it yet so they are written in place
+	pending   []uint64
+	allocated map[uint64]bool
 }
 
 type MetaRecord struct {
 	name     string
 	rootpage uint64
+	sequence uint64 // last value returned by Bucket.NextSequence
+
+	comparator string // name of the Comparator of the bucket, empty for bytes.Compare
+}
+
+// meta page layout after the page header
+//
+//	[0:4]    magic
+//	[4:8]    format version
+//	[8:16]   last page id
+//	[16:24]  number of buckets
+//	[24:32]  first freelist page
+//	[32:40]  id of the last committed transaction
+//	bucket records: name length as a uvarint and name, root page id,
+//	sequence, comparator name length as a uvarint and comparator name
+const (
+	metaMagic      = 0x6b766462
+	metaHeaderSize = 40
+)
+
+// formatVersion is the version of the file format, files of other versions
+// are not opened. files written before the version was recorded have a
+// zero magic
+const formatVersion = 3
+
+var (
+	// ErrFormatVersion is returned by Open for files written in another
+	// format version
+	ErrFormatVersion = errors.New("unsupported file format version")
+	// ErrTooManyBuckets is returned when committing a transaction whose
+	// bucket records do not fit in the meta page
+	ErrTooManyBuckets = errors.New("too many buckets for the meta page")
+)
+
+// size is the number of bytes of the record in the meta page
+func (r *MetaRecord) size() int {
+	return uvarintSize(len(r.name)) + len(r.name) + 8 + 8 + uvarintSize(len(r.comparator)) + len(r.comparator)
+}
+
+func uvarintSize(n int) int {
+	return len(binary.AppendUvarint(nil, uint64(n)))
 }
 
+// getNewPageID reuses a free page if there is one, otherwise it allocates
+// a page at the end of the file
 func (m *Meta) getNewPageID() uint64 {
 	m.mu.Lock()
-	m.pgid++
-	m.mu.Unlock()
+	defer m.mu.Unlock()
+
+	var pgid uint64
+	if len(m.freelist) > 0 {
+		pgid = m.freelist[0]
+		m.freelist = m.freelist[1:]
+	} else {
+		m.pgid++
+		pgid = m.pgid
+	}
 
-	// @todo: persist meta page to disk to reflect last page id
+	if m.allocated == nil {
+		m.allocated = make(map[uint64]bool)
+	}
+	m.allocated[pgid] = true
 
-	return m.pgid
+	return pgid
 }
 
-// newBucket should be called only from DB.Bucket()
-func (m *Meta) newBucket(db *DB, s string) *Bucket {
+// isAllocated reports whether the page was allocated by the writable
+// transaction
+func (m *Meta) isAllocated(pgid uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.allocated[pgid]
+}
+
+// newBucket should be called only from DB.bucket()
+func (m *Meta) newBucket(s string, rootpage uint64, comparator string) *MetaRecord {
 	// create new bucket
 	record := &MetaRecord{
-		name:     s,
-		rootpage: m.getNewPageID(),
+		name:       s,
+		rootpage:   rootpage,
+		comparator: comparator,
 	}
 
 	m.mu.Lock()
 	m.buckets = append(m.buckets, record)
 	m.mu.Unlock()
 
-	return newBucket(db, record.rootpage)
+	return record
+}
+
+// record returns the meta record of the named bucket
+func (m *Meta) record(s string) *MetaRecord {
+	for _, record := range m.buckets {
+		if record.name == s {
+			return record
+		}
+	}
+
+	return nil
 }
 
 func (db *DB) newMeta() error {
 	db.meta = &Meta{
-		buckets: make([]*MetaRecord, 0),
-		pgid:    0,
+		buckets:  make([]*MetaRecord, 0),
+		pgid:     0,
+		freelist: make([]uint64, 0),
 	}
 
 	return db.writeMeta()
 }
 
-// meta page is always the first page
-func (db *DB) writeMeta() error {
-	bytes := make([]byte, META_PAGE_SIZE)
+// metaOffset returns where the copy of the meta page written by the
+// transaction txid is. commits write the copy the last commit did not, so a
+// write cut short leaves the other one intact
+func metaOffset(txid uint64) int64 {
+	return int64(txid%2) * META_PAGE_SIZE
+}
 
-	// write meta
-	_, err := db.file.Seek(0, 0)
-	if err != nil {
-		return err
-	}
+// meta page is always the first page, it is written at the copy of the
+// transaction, see metaOffset
+func (db *DB) writeMeta() error {
+	page := make([]byte, META_PAGE_SIZE)
+	// meta follows the page header
+	bytes := page[pageHeaderSize : pageHeaderSize+metaHeaderSize]
 
+	binary.LittleEndian.PutUint32(bytes[0:4], metaMagic)
+	binary.LittleEndian.PutUint32(bytes[4:8], formatVersion)
 	// append meta page id
-	binary.LittleEndian.PutUint64(bytes[0:8], db.meta.pgid)
-
+	binary.LittleEndian.PutUint64(bytes[8:16], db.meta.pgid)
 	// append length of meta
-	size := len(db.meta.buckets)
-	binary.LittleEndian.PutUint64(bytes[8:16], uint64(size))
-	offset := 16
+	binary.LittleEndian.PutUint64(bytes[16:24], uint64(len(db.meta.buckets)))
+	// append first page of the freelist
+	binary.LittleEndian.PutUint64(bytes[24:32], db.meta.freelistPage)
+	// append id of the last committed transaction
+	binary.LittleEndian.PutUint64(bytes[32:40], db.meta.txid)
+
 	// append meta buckets
+	bytes = bytes[len(bytes):]
 	for _, bucket := range db.meta.buckets {
-		// append name
-		copy(bytes[offset:offset+100], []byte(bucket.name))
-		offset += 100
-		// append pageroot
-		binary.LittleEndian.PutUint64(bytes[offset:offset+8], uint64(bucket.rootpage))
-		offset += 8
-	}
+		bytes = appendBytes(bytes, []byte(bucket.name))
+		bytes = binary.LittleEndian.AppendUint64(bytes, bucket.rootpage)
+		bytes = binary.LittleEndian.AppendUint64(bytes, bucket.sequence)
+		bytes = appendBytes(bytes, []byte(bucket.comparator))
 
-	_, err = db.file.Write(bytes)
-	if err != nil {
-		return err
+		// appending past the page allocates a new array
+		if len(bytes) > META_PAGE_SIZE-pageHeaderSize-metaHeaderSize {
+			return ErrTooManyBuckets
+		}
 	}
 
-	return nil
+	return db.writePageAt(0, PAGE_TYPE_META, page, metaOffset(db.meta.txid))
 }
 
+// readMeta reads both copies of the meta page and returns the one of the
+// last transaction, a copy that cannot be read was cut short by a commit
 func (db *DB) readMeta() (*Meta, error) {
-	// read meta
-	_, err := db.file.Seek(0, 0)
-	if err != nil {
-		return nil, err
+	var meta *Meta
+	var errs [2]error
+	for i := uint64(0); i < 2; i++ {
+		page, err := db.readPageAt(0, metaOffset(i))
+		if err == nil && page[8] != PAGE_TYPE_META {
+			err = errNotMeta
+		}
+
+		var m *Meta
+		if err == nil {
+			m, err = decodeMeta(page)
+		}
+
+		errs[i] = err
+		if err == nil && (meta == nil || m.txid > meta.txid) {
+			meta = m
+		}
 	}
 
-	bytes := make([]byte, META_PAGE_SIZE)
-	_, err = db.file.Read(bytes)
-	if err != nil {
-		return nil, err
+	switch {
+	case meta != nil:
+		return meta, nil
+	case errors.Is(errs[0], errPageNotWritten) || errs[0] == errNotMeta:
+		return nil, fmt.Errorf("%s is not a kvdb file", db.path)
+	default:
+		return nil, fmt.Errorf("%s: %w", db.path, errs[0])
+	}
+}
+
+var errNotMeta = errors.New("page 0 is not a meta page")
+
+// decodeMeta reads the meta page
+func decodeMeta(page []byte) (*Meta, error) {
+	// meta follows the page header
+	bytes := page[pageHeaderSize:]
+
+	magic := binary.LittleEndian.Uint32(bytes[0:4])
+	version := binary.LittleEndian.Uint32(bytes[4:8])
+	if magic != metaMagic {
+		// older files start with the last page id
+		return nil, fmt.Errorf("file written before format versions: %w", ErrFormatVersion)
+	}
+	if version != formatVersion {
+		return nil, fmt.Errorf("file has format version %d, expected %d: %w", version, formatVersion, ErrFormatVersion)
 	}
 
 	m := &Meta{}
 
 	// read meta page id
-	m.pgid = binary.LittleEndian.Uint64(bytes[0:8])
-
+	m.pgid = binary.LittleEndian.Uint64(bytes[8:16])
 	// read length of meta
-	size := binary.LittleEndian.Uint64(bytes[8:16])
-	offset := 16
+	size := binary.LittleEndian.Uint64(bytes[16:24])
+	// read first page of the freelist
+	m.freelistPage = binary.LittleEndian.Uint64(bytes[24:32])
+	// read id of the last committed transaction
+	m.txid = binary.LittleEndian.Uint64(bytes[32:40])
+
 	// read meta buckets
-	var i uint64
-	for i = 0; i < size; i++ {
+	data := bytes[metaHeaderSize:]
+	for i := uint64(0); i < size; i++ {
 		b := &MetaRecord{}
-		// read name
-		b.name = string(bytes[offset : offset+100])
-		offset += 100
-		// read pageroot
-		b.rootpage = binary.LittleEndian.Uint64(bytes[offset : offset+8])
-		offset += 8
 
-		// trim null bytes so the name has the correct length
-		b.name = strings.TrimRight(string(b.name), "\x00")
+		name, rest, err := readBytes(data)
+		if err == nil && len(rest) < 16 {
+			err = errShortBuffer
+		}
+		if err != nil {
+			return nil, fmt.Errorf("meta page is corrupted, bucket record %d: %w", i, err)
+		}
+		b.name = string(name)
+		// read pageroot
+		b.rootpage = binary.LittleEndian.Uint64(rest[0:8])
+		// read sequence
+		b.sequence = binary.LittleEndian.Uint64(rest[8:16])
+		// read comparator name
+		comparator, rest, err := readBytes(rest[16:])
+		if err != nil {
+			return nil, fmt.Errorf("meta page is corrupted, comparator of bucket record %d: %w", i, err)
+		}
+		b.comparator = string(comparator)
+		data = rest
 
 		m.buckets = append(m.buckets, b)
 	}
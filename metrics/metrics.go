@@ -0,0 +1,98 @@
+// Package metrics exports the statistics of a kvdb database with expvar and
+// in the Prometheus text format. the statistics are read from DB.Stats every
+// time they are requested, so nothing runs in the background
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+
+	"ahmedash95/kvdb"
+)
+
+// Publish registers the statistics of db with expvar under name. like
+// expvar.Publish it panics if the name is already registered
+func Publish(name string, db *kvdb.DB) {
+	expvar.Publish(name, expvar.Func(func() any {
+		stats, err := db.Stats()
+		if err != nil {
+			return err.Error()
+		}
+
+		return stats
+	}))
+}
+
+// Handler returns an http.Handler serving the statistics of db in the
+// Prometheus text format, every metric is prefixed with kvdb_
+func Handler(db *kvdb.DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := db.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WritePrometheus(w, stats)
+	})
+}
+
+// WritePrometheus writes stats in the Prometheus text format
+func WritePrometheus(w io.Writer, stats kvdb.Stats) error {
+	bw := bufio.NewWriter(w)
+
+	counter := func(name string, help string, value int64) {
+		fmt.Fprintf(bw, "# HELP kvdb_%s %s\n# TYPE kvdb_%s counter\nkvdb_%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name string, help string, value float64) {
+		fmt.Fprintf(bw, "# HELP kvdb_%s %s\n# TYPE kvdb_%s gauge\nkvdb_%s %g\n", name, help, name, name, value)
+	}
+
+	counter("gets_total", "Keys read from user buckets.", stats.GetN)
+	counter("puts_total", "Keys written to user buckets.", stats.PutN)
+	counter("deletes_total", "Keys deleted from user buckets.", stats.DeleteN)
+	counter("splits_total", "Nodes split because they were full.", stats.SplitN)
+	counter("page_allocations_total", "Pages taken for new nodes and the freelist.", stats.PageAllocN)
+	counter("page_frees_total", "Pages given back to the freelist.", stats.PageFreeN)
+	counter("commits_total", "Writable transactions committed.", stats.CommitN)
+	counter("rollbacks_total", "Writable transactions rolled back.", stats.RollbackN)
+	counter("read_transactions_total", "Read-only transactions started.", stats.TxN)
+	counter("write_transactions_total", "Writable transactions started.", stats.WriteTxN)
+	counter("cache_hits_total", "Nodes found in memory.", stats.CacheHitN)
+	counter("cache_misses_total", "Nodes read from disk.", stats.CacheMissN)
+
+	ratio := 0.0
+	if lookups := stats.CacheHitN + stats.CacheMissN; lookups > 0 {
+		ratio = float64(stats.CacheHitN) / float64(lookups)
+	}
+	gauge("cache_hit_ratio", "Share of node lookups found in memory.", ratio)
+	gauge("open_transactions", "Transactions not closed yet.", float64(stats.OpenTxN))
+	gauge("pages", "Pages in the file.", float64(stats.PageN))
+	gauge("free_pages", "Pages in the freelist.", float64(stats.FreePageN))
+	gauge("file_size_bytes", "Size of the file.", float64(stats.FileSize))
+	gauge("buckets", "Buckets in the database.", float64(stats.BucketN))
+
+	histogram(bw, "commit_duration_seconds", "Time a commit takes, fsync included.", stats.CommitLatency)
+	histogram(bw, "fsync_duration_seconds", "Time an fsync takes, a commit syncs twice.", stats.SyncLatency)
+
+	return bw.Flush()
+}
+
+func histogram(w io.Writer, name string, help string, h kvdb.Histogram) {
+	fmt.Fprintf(w, "# HELP kvdb_%s %s\n# TYPE kvdb_%s histogram\n", name, help, name)
+
+	// prometheus buckets count every value up to their bound
+	var cumulative int64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "kvdb_%s_bucket{le=\"%g\"} %d\n", name, bound.Seconds(), cumulative)
+	}
+
+	fmt.Fprintf(w, "kvdb_%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "kvdb_%s_sum %g\n", name, h.Sum.Seconds())
+	fmt.Fprintf(w, "kvdb_%s_count %d\n", name, h.Count)
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ahmedash95/kvdb"
+)
+
+func openDB(t *testing.T) *kvdb.DB {
+	db, err := kvdb.Open(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	bucket, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := bucket.Put([]byte(fmt.Sprintf("user%d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bucket.Get([]byte("user1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Delete([]byte("user2")); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestHandler(t *testing.T) {
+	db := openDB(t)
+
+	server := httptest.NewServer(Handler(db))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected content type %s", res.Header.Get("Content-Type"))
+	}
+
+	expected := []string{
+		"# TYPE kvdb_puts_total counter\nkvdb_puts_total 10\n",
+		"kvdb_gets_total 1\n",
+		"kvdb_deletes_total 1\n",
+		"kvdb_commits_total 12\n",
+		"# TYPE kvdb_cache_hit_ratio gauge\nkvdb_cache_hit_ratio 1\n",
+		"# TYPE kvdb_commit_duration_seconds histogram\n",
+		"kvdb_commit_duration_seconds_bucket{le=\"+Inf\"} 12\n",
+		"kvdb_fsync_duration_seconds_count 24\n",
+	}
+	for _, text := range expected {
+		if !strings.Contains(string(body), text) {
+			t.Fatalf("expected the scrape to contain %q but got\n%s", text, body)
+		}
+	}
+
+	// buckets are cumulative
+	var last int64 = -1
+	for _, line := range strings.Split(string(body), "\n") {
+		if !strings.HasPrefix(line, "kvdb_commit_duration_seconds_bucket") {
+			continue
+		}
+
+		var count int64
+		fmt.Sscan(line[strings.LastIndex(line, " ")+1:], &count)
+		if count < last {
+			t.Fatalf("expected cumulative buckets but got %s after %d", line, last)
+		}
+		last = count
+	}
+}
+
+func TestPublish(t *testing.T) {
+	db := openDB(t)
+
+	Publish("kvdb_test", db)
+
+	var stats kvdb.Stats
+	if err := json.Unmarshal([]byte(expvar.Get("kvdb_test").String()), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.PutN != 10 || stats.BucketN != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -1,7 +1,6 @@
 package kvdb
 
 import (
-	"bytes"
 	"sort"
 )
 
@@ -13,11 +12,12 @@ type Node struct {
 	Keys     [][]byte // keys of internal nodes
 	children []uint64 // pgid of children nodes
 	values   [][]byte // values of leaf nodes
+	dirty    bool     // node changed since it was last written to disk
 }
 
 func (n Node) findKey(key []byte) (int, bool) {
 	for i, k := range n.Keys {
-		if bytes.Compare(k, key) == 0 {
+		if n.bucket.compare(k, key) == 0 {
 			return i, true
 		}
 	}
@@ -27,33 +27,56 @@ func (n Node) findKey(key []byte) (int, bool) {
 
 func (n *Node) insert(key []byte, value []byte) {
 	// find index where key should be inserted
-	i := sort.Search(len(n.Keys), func(i int) bool { return bytes.Compare(n.Keys[i], key) != -1 })
+	i := sort.Search(len(n.Keys), func(i int) bool { return n.bucket.compare(n.Keys[i], key) >= 0 })
 
 	// insert new key
 	n.Keys = append(n.Keys[:i], append([][]byte{key}, n.Keys[i:]...)...)
 
 	// insert new value
 	n.values = append(n.values[:i], append([][]byte{value}, n.values[i:]...)...)
+
+	n.dirty = true
 }
 
+// split splits the node if it is full, and then its parent which got a key
+// for the new sibling
 func (n *Node) split() {
-	if len(n.Keys) <= n.bucket.db.config.maxKeysPerNode {
+	// a single key that does not fit in a page cannot be split, encoding
+	// the node fails on commit
+	if !n.full() || len(n.Keys) < 2 {
 		return
 	}
 
+	n.dirty = true
+	n.bucket.db.counters.splitN.Add(1)
+
+	var sibling *Node
 	if n.typ == NODE_TYPE_LEAF {
-		n.splitLeaf()
+		sibling = n.splitLeaf()
 	} else {
-		n.splitInternal()
+		sibling = n.splitInternal()
+	}
+
+	n.bucket.db.config.Hooks.OnSplit(n.bucket.name, n.pgid, sibling.pgid)
+
+	// halves of large values may still not fit in a page
+	n.split()
+	sibling.split()
+
+	n.bucket.node(n.parent).split()
+}
+
+// full reports whether the node has more keys than a node holds or does not
+// fit in a page. nodes of keys inserted in order fill their page, see Compact
+func (n *Node) full() bool {
+	if n.bucket.sequential {
+		return n.size() > PAGE_SIZE
 	}
 
-	//parent := n.bucket.node(n.parent)
-	//if len(parent.Keys) > MAX_KEYS_PER_NODE {
-	//	parent.split()
-	//}
+	return len(n.Keys) > n.bucket.db.config.maxKeysPerNode || n.size() > PAGE_SIZE
 }
 
-func (n *Node) splitLeaf() {
+func (n *Node) splitLeaf() *Node {
 	if n.typ != NODE_TYPE_LEAF {
 		panic("cannot split non-leaf node")
 	}
@@ -77,26 +100,30 @@ func (n *Node) splitLeaf() {
 	sibling := n.bucket.newLeafNode()
 
 	// now we split the keys, values and children between the current node and the sibling node
-	n.Keys, sibling.Keys = n.splitTwoKeys()
-	n.values, sibling.values = n.splitTwoValues()
+	mid := n.splitMid()
+	n.Keys, sibling.Keys = n.splitTwoKeys(mid)
+	n.values, sibling.values = n.splitTwoValues(mid)
 	n.children, sibling.children = n.splitTwoChildren()
 
 	// we must update the parent of the sibling node
 	sibling.parent = parent.pgid
-	// the parent node must have the sibling node as a child
-	parent.addChild(sibling.pgid)
+	// the parent node must have the sibling node as a child, right after the current node
+	parent.addChildAfter(n.pgid, sibling.pgid)
 
 	// as we have split the keys, sibling node children must be updated
 	//to have the sibling node as a parent
 	for _, child := range sibling.children {
-		n.bucket.node(child).parent = sibling.pgid
+		childNode := n.child(child)
+		childNode.parent = sibling.pgid
+		childNode.dirty = true
 	}
 	// and also parent node to have the sibling node's key as a key
 	parent.addKey(sibling.Keys[0])
 
+	return sibling
 }
 
-func (n *Node) splitInternal() {
+func (n *Node) splitInternal() *Node {
 	if n.typ != NODE_TYPE_INTERNAL {
 		panic("cannot split non-internal node")
 	}
@@ -118,44 +145,60 @@ func (n *Node) splitInternal() {
 	// the first half will be the current node
 
 	// pick the middle key and promote it to the parent node
-	midKey := n.Keys[len(n.Keys)/2]
+	mid := n.splitMid()
+	midKey := n.Keys[mid]
 	parent.addKey(midKey)
 
 	sibling := n.bucket.newInternalNode()
 
-	// now we split the keys, values and children between the current node and the sibling node
-	n.Keys, sibling.Keys = n.splitTwoKeys()
-
 	// splitting internal node is a bit different
-	// we take one key out of the sibling node and put it in the parent node
-	if len(sibling.Keys) > 1 {
-		sibling.Keys = sibling.Keys[1:]
-	}
+	// the keys on the left of the promoted key stay in the current node
+	// and the keys on its right move to the sibling node
+	keys := n.Keys
+	n.Keys = make([][]byte, mid)
+	copy(n.Keys, keys[:mid])
+	sibling.Keys = make([][]byte, len(keys)-mid-1)
+	copy(sibling.Keys, keys[mid+1:])
+
+	// every key has a child on each side, so the current node keeps
+	// one child more than its keys and the sibling takes the rest
+	children := n.children
+	n.children = make([]uint64, mid+1)
+	copy(n.children, children[:mid+1])
+	sibling.children = make([]uint64, len(children)-mid-1)
+	copy(sibling.children, children[mid+1:])
 
-	n.children, sibling.children = n.splitTwoChildren()
 	// internal node does not have values
 	sibling.values = make([][]byte, 0)
 	// we must update the parent of the sibling node
 	sibling.parent = n.parent
-	// the parent node must have the sibling node as a child
-	parent.addChild(sibling.pgid)
+	// the parent node must have the sibling node as a child, right after the current node
+	parent.addChildAfter(n.pgid, sibling.pgid)
 
 	// as we have split the keys, sibling node children must be updated
 	//to have the sibling node as a parent
 	for _, child := range sibling.children {
-		n.bucket.node(child).parent = sibling.pgid
+		childNode := n.child(child)
+		childNode.parent = sibling.pgid
+		childNode.dirty = true
 	}
 
+	return sibling
+}
+
+// child returns the child node pgid of n
+func (n *Node) child(pgid uint64) *Node {
+	return n.bucket.load(pgid, n.pgid)
 }
 
 func (n *Node) addChild(pgid uint64) {
 	// find index where child should be inserted based on the key
-	newNode := n.bucket.node(pgid)
+	newNode := n.child(pgid)
 
 	i := sort.Search(len(n.children), func(i int) bool {
-		currentNode := n.bucket.node(n.children[i])
+		currentNode := n.child(n.children[i])
 
-		return bytes.Compare(currentNode.Keys[0], newNode.Keys[0]) != -1
+		return n.bucket.compare(currentNode.Keys[0], newNode.Keys[0]) >= 0
 	})
 
 	newChildren := make([]uint64, len(n.children)+1)
@@ -164,19 +207,50 @@ func (n *Node) addChild(pgid uint64) {
 	copy(newChildren[i+1:], n.children[i:])
 
 	n.children = newChildren
+	n.dirty = true
+}
+
+// addChildAfter inserts the child right after prev, which is where the
+// sibling of a split node belongs
+func (n *Node) addChildAfter(prev uint64, pgid uint64) {
+	i := 0
+	for j, child := range n.children {
+		if child == prev {
+			i = j + 1
+			break
+		}
+	}
+
+	newChildren := make([]uint64, len(n.children)+1)
+	copy(newChildren, n.children[:i])
+	newChildren[i] = pgid
+	copy(newChildren[i+1:], n.children[i:])
+
+	n.children = newChildren
+	n.dirty = true
 }
 
 func (n *Node) addKey(key []byte) {
 	// find index where key should be inserted
-	i := sort.Search(len(n.Keys), func(i int) bool { return bytes.Compare(n.Keys[i], key) != -1 })
+	i := sort.Search(len(n.Keys), func(i int) bool { return n.bucket.compare(n.Keys[i], key) >= 0 })
 
 	// insert new key
 	n.Keys = append(n.Keys[:i], append([][]byte{key}, n.Keys[i:]...)...)
+	n.dirty = true
+}
+
+// splitMid returns where a full node is split. when keys are inserted in
+// order nothing is inserted on the left again, so the left node is kept full
+func (n *Node) splitMid() int {
+	if n.bucket.sequential {
+		return len(n.Keys) - 1
+	}
+
+	return len(n.Keys) / 2
 }
 
-// splitTwoKeys splits the keys into two halves and return 2 new copies of keys
-func (n *Node) splitTwoKeys() ([][]byte, [][]byte) {
-	mid := len(n.Keys) / 2
+// splitTwoKeys splits the keys at mid and return 2 new copies of keys
+func (n *Node) splitTwoKeys(mid int) ([][]byte, [][]byte) {
 	left := make([][]byte, mid)
 	right := make([][]byte, len(n.Keys)-mid)
 
@@ -186,8 +260,7 @@ func (n *Node) splitTwoKeys() ([][]byte, [][]byte) {
 	return left, right
 }
 
-func (n *Node) splitTwoValues() ([][]byte, [][]byte) {
-	mid := len(n.values) / 2
+func (n *Node) splitTwoValues(mid int) ([][]byte, [][]byte) {
 	left := make([][]byte, mid)
 	right := make([][]byte, len(n.values)-mid)
 
@@ -209,20 +282,83 @@ func (n *Node) splitTwoChildren() ([]uint64, []uint64) {
 }
 
 func (n *Node) scan(f func(key []byte, value []byte) bool) {
+	n.scanRange(nil, nil, f)
+}
+
+// scanRange calls f for every key in [start, end) in order, nil bounds are
+// open. it returns false once f asked to stop or the end of the range was
+// passed
+func (n *Node) scanRange(start []byte, end []byte, f func(key []byte, value []byte) bool) bool {
 	if n.typ == NODE_TYPE_LEAF {
 		for i := 0; i < len(n.Keys); i++ {
+			if start != nil && n.bucket.compare(n.Keys[i], start) < 0 {
+				continue
+			}
+			if end != nil && n.bucket.compare(n.Keys[i], end) >= 0 {
+				return false
+			}
 			if !f(n.Keys[i], n.values[i]) {
-				return
+				return false
 			}
 		}
 
-		return
+		return true
 	}
 
-	// scan all children of the internal node
+	// scan the children of the internal node that may hold keys in the range
 	for i := 0; i < len(n.children); i++ {
-		n.bucket.node(n.children[i]).scan(f)
+		// the child holds the keys in [lower, upper), nil bounds are open
+		if start != nil && i < len(n.Keys) && n.bucket.compare(n.Keys[i], start) <= 0 {
+			continue
+		}
+		if end != nil && i > 0 && i-1 < len(n.Keys) && n.bucket.compare(n.Keys[i-1], end) >= 0 {
+			return false
+		}
+
+		if !n.child(n.children[i]).scanRange(start, end, f) {
+			return false
+		}
 	}
+
+	return true
+}
+
+// scanRangeReverse calls f for every key in [start, end) from the last one,
+// nil bounds are open. it returns false once f asked to stop or the start of
+// the range was passed
+func (n *Node) scanRangeReverse(start []byte, end []byte, f func(key []byte, value []byte) bool) bool {
+	if n.typ == NODE_TYPE_LEAF {
+		for i := len(n.Keys) - 1; i >= 0; i-- {
+			if end != nil && n.bucket.compare(n.Keys[i], end) >= 0 {
+				continue
+			}
+			if start != nil && n.bucket.compare(n.Keys[i], start) < 0 {
+				return false
+			}
+			if !f(n.Keys[i], n.values[i]) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// scan the children of the internal node that may hold keys in the range
+	for i := len(n.children) - 1; i >= 0; i-- {
+		// the child holds the keys in [lower, upper), nil bounds are open
+		if end != nil && i > 0 && i-1 < len(n.Keys) && n.bucket.compare(n.Keys[i-1], end) >= 0 {
+			continue
+		}
+		if start != nil && i < len(n.Keys) && n.bucket.compare(n.Keys[i], start) <= 0 {
+			return false
+		}
+
+		if !n.child(n.children[i]).scanRangeReverse(start, end, f) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (n *Node) delete(i int) {
@@ -235,6 +371,7 @@ func (n *Node) delete(i int) {
 	copy(newValues, n.values[:i])
 	copy(newValues[i:], n.values[i+1:])
 	n.values = newValues
+	n.dirty = true
 }
 
 func (n *Node) possibleFree(pgid uint64) {
@@ -242,30 +379,170 @@ func (n *Node) possibleFree(pgid uint64) {
 		panic("cannot free node from non-internal node")
 	}
 
-	node := n.bucket.node(pgid)
+	node := n.child(pgid)
 
 	// if the node is not empty, we cannot free it
-	if len(node.Keys) > 0 {
+	if !node.isEmpty() {
 		return
 	}
 
 	// if the node is empty, we must remove it from the parent node
+	// and give its page back to the freelist
 	n.removeChild(pgid)
+	n.bucket.free(node)
+	n.bucket.db.config.Hooks.OnMerge(n.bucket.name, pgid, n.pgid)
 
-	// @todo: add the node to the freelist
+	// an internal node left without children is empty as well
+	if len(n.children) > 0 {
+		return
+	}
+
+	if n.parent != 0 {
+		n.bucket.node(n.parent).possibleFree(n.pgid)
+		return
+	}
+
+	// the root lost all of its children, so the bucket is empty again
+	n.becomeEmptyLeaf()
+}
+
+// becomeEmptyLeaf turns a root left without children into an empty leaf
+func (n *Node) becomeEmptyLeaf() {
+	n.typ = NODE_TYPE_LEAF
+	n.Keys = make([][]byte, 0)
+	n.children = make([]uint64, 0)
+	n.values = make([][]byte, 0)
+	n.dirty = true
 }
 
+// deleteRange removes the keys in [start, end) from the subtree of the node
+// and returns how many were removed. a nil start or end leaves the range
+// open on that side. children whose whole key range is covered are released
+// without looking at their keys one by one
+func (n *Node) deleteRange(start []byte, end []byte) int {
+	if n.typ == NODE_TYPE_LEAF {
+		count := 0
+		for i := 0; i < len(n.Keys); {
+			if n.bucket.inRange(n.Keys[i], start, end) {
+				n.delete(i)
+				count++
+				continue
+			}
+			i++
+		}
+
+		return count
+	}
+
+	count := 0
+	for i := 0; i < len(n.children); {
+		// the child holds the keys in [lower, upper), nil bounds are open
+		var lower, upper []byte
+		if i > 0 && i-1 < len(n.Keys) {
+			lower = n.Keys[i-1]
+		}
+		if i < len(n.Keys) {
+			upper = n.Keys[i]
+		}
+
+		// children are sorted, the ones after this one are past the range too
+		if end != nil && lower != nil && n.bucket.compare(lower, end) >= 0 {
+			break
+		}
+
+		if start != nil && upper != nil && n.bucket.compare(upper, start) <= 0 {
+			i++
+			continue
+		}
+
+		child := n.child(n.children[i])
+
+		covered := (start == nil || (lower != nil && n.bucket.compare(lower, start) >= 0)) &&
+			(end == nil || (upper != nil && n.bucket.compare(upper, end) <= 0))
+		if covered {
+			count += child.freeTree()
+			n.removeChild(child.pgid)
+			n.bucket.db.config.Hooks.OnMerge(n.bucket.name, child.pgid, n.pgid)
+			continue
+		}
+
+		count += child.deleteRange(start, end)
+		if child.isEmpty() {
+			n.removeChild(child.pgid)
+			n.bucket.free(child)
+			n.bucket.db.config.Hooks.OnMerge(n.bucket.name, child.pgid, n.pgid)
+			continue
+		}
+
+		i++
+	}
+
+	return count
+}
+
+// freeTree releases the pages of the node and its whole subtree and returns
+// the number of keys they held
+func (n *Node) freeTree() int {
+	count := 0
+	if n.typ == NODE_TYPE_LEAF {
+		count = len(n.Keys)
+	}
+
+	for _, child := range n.children {
+		count += n.child(child).freeTree()
+	}
+
+	n.bucket.free(n)
+
+	return count
+}
+
+// inRange reports whether key is in [start, end), nil bounds are open
+func (b *bucket) inRange(key []byte, start []byte, end []byte) bool {
+	if start != nil && b.compare(key, start) < 0 {
+		return false
+	}
+
+	return end == nil || b.compare(key, end) < 0
+}
+
+// isEmpty reports whether a leaf has no keys or an internal node has no children
+func (n *Node) isEmpty() bool {
+	if n.typ == NODE_TYPE_LEAF {
+		return len(n.Keys) == 0
+	}
+
+	return len(n.children) == 0
+}
+
+// removeChild removes the child and the key separating it from its siblings
 func (n *Node) removeChild(pgid uint64) {
 	var newChildren []uint64
-	for _, child := range n.children {
-		if child == pgid {
+	for i, child := range n.children {
+		if child != pgid {
+			newChildren = append(newChildren, child)
 			continue
 		}
 
-		newChildren = append(newChildren, child)
+		// the first child has no key on its left, so drop the one on its right
+		if len(n.Keys) > 0 {
+			k := i - 1
+			if k < 0 {
+				k = 0
+			}
+			if k >= len(n.Keys) {
+				k = len(n.Keys) - 1
+			}
+			n.Keys = append(n.Keys[:k:k], n.Keys[k+1:]...)
+		}
+	}
+
+	if newChildren == nil {
+		newChildren = make([]uint64, 0)
 	}
 
 	n.children = newChildren
+	n.dirty = true
 }
 
 func newNode(b *Bucket, pgid uint64, typ uint8) *Node {
@@ -0,0 +1,265 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// every page starts with a header
+//
+//	[0:8]    page id
+//	[8]      page type
+//	[9:13]   CRC32C checksum of the page, computed with this field set to zero
+const pageHeaderSize = 13
+
+// node page layout after the page header
+//
+//	[13:15]  number of keys
+//	[15:17]  number of children
+//	children page ids, 8 bytes each
+//	keys, each prefixed by a 2 bytes length and followed by the value
+//	prefixed by a 4 bytes length when the node is a leaf
+//
+// the parent is not stored, commits move nodes to new pages and would have
+// to rewrite every child of a moved node. a node learns its parent when it
+// is reached from it
+const nodeHeaderSize = pageHeaderSize + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumMismatch is returned when a page read from disk does not match
+// the checksum it was written with
+type ErrChecksumMismatch struct {
+	PageID uint64
+}
+
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("page %d checksum mismatch", e.PageID)
+}
+
+// errPageNotWritten is returned when reading a page no commit wrote. only
+// the root of an empty bucket may not have been written
+var errPageNotWritten = errors.New("page was never written")
+
+// readError carries a failed page read out of Bucket.node, which has no
+// error to return, up to the Bucket method that started the walk
+type readError struct {
+	err error
+}
+
+func recoverReadError(err *error) {
+	if r := recover(); r != nil {
+		re, ok := r.(readError)
+		if !ok {
+			panic(r)
+		}
+
+		*err = re.err
+	}
+}
+
+// pageOffset returns where a page starts in the file. the meta page is
+// page 0, its two copies come before every other page
+func pageOffset(pgid uint64) int64 {
+	if pgid == 0 {
+		return 0
+	}
+
+	return DB_HEADER + int64(pgid-1)*PAGE_SIZE
+}
+
+func pageChecksum(buf []byte) uint32 {
+	checksum := crc32.Update(0, castagnoli, buf[:9])
+	checksum = crc32.Update(checksum, castagnoli, []byte{0, 0, 0, 0})
+	return crc32.Update(checksum, castagnoli, buf[pageHeaderSize:])
+}
+
+// writePage fills in the header of buf and writes it as the page pgid
+func (db *DB) writePage(pgid uint64, typ uint8, buf []byte) error {
+	// running backups still need what the page held before this write
+	db.preserve(pgid)
+
+	return db.writePageAt(pgid, typ, buf, pageOffset(pgid))
+}
+
+// writePageAt fills in the header of buf and writes it at offset
+func (db *DB) writePageAt(pgid uint64, typ uint8, buf []byte, offset int64) error {
+	binary.LittleEndian.PutUint64(buf[0:8], pgid)
+	buf[8] = typ
+	binary.LittleEndian.PutUint32(buf[9:13], pageChecksum(buf))
+
+	_, err := db.file.WriteAt(buf, offset)
+	return err
+}
+
+// readPage reads the page pgid and verifies its header. it returns
+// errPageNotWritten if the page is past the end of the file or holds only
+// zeros
+func (db *DB) readPage(pgid uint64) ([]byte, error) {
+	return db.readPageAt(pgid, pageOffset(pgid))
+}
+
+// readPageAt reads the page pgid stored at offset, see readPage
+func (db *DB) readPageAt(pgid uint64, offset int64) ([]byte, error) {
+	buf := make([]byte, PAGE_SIZE)
+	n, err := db.file.ReadAt(buf, offset)
+	if err == io.EOF && n == 0 {
+		return nil, fmt.Errorf("page %d: %w", pgid, errPageNotWritten)
+	}
+	if err == io.EOF {
+		return nil, fmt.Errorf("page %d is cut short at %d bytes", pgid, n)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// pages allocated after the last written one are holes filled with zeros
+	if bytes.Equal(buf, make([]byte, PAGE_SIZE)) {
+		return nil, fmt.Errorf("page %d: %w", pgid, errPageNotWritten)
+	}
+
+	if binary.LittleEndian.Uint32(buf[9:13]) != pageChecksum(buf) {
+		return nil, ErrChecksumMismatch{PageID: pgid}
+	}
+
+	if id := binary.LittleEndian.Uint64(buf[0:8]); id != pgid {
+		return nil, fmt.Errorf("page %d holds page %d", pgid, id)
+	}
+
+	return buf, nil
+}
+
+// readNode loads a node from disk
+func (db *DB) readNode(b *Bucket, pgid uint64) (*Node, error) {
+	if pgid == 0 {
+		return nil, fmt.Errorf("page 0 is the meta page")
+	}
+
+	buf, err := db.readPage(pgid)
+	if err != nil {
+		return nil, err
+	}
+
+	node := newNode(b, pgid, buf[8])
+	if err := node.decode(buf); err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func (db *DB) writeNode(n *Node) error {
+	buf, err := n.encode()
+	if err != nil {
+		return err
+	}
+
+	return db.writePage(n.pgid, n.typ, buf)
+}
+
+// size returns the number of bytes the node takes on its page
+func (n *Node) size() int {
+	size := nodeHeaderSize + len(n.children)*8
+	for i, key := range n.Keys {
+		size += 2 + len(key)
+		if n.typ == NODE_TYPE_LEAF {
+			size += 4 + len(n.values[i])
+		}
+	}
+
+	return size
+}
+
+func (n *Node) encode() ([]byte, error) {
+	if n.size() > PAGE_SIZE {
+		return nil, fmt.Errorf("node %d does not fit in a page", n.pgid)
+	}
+
+	buf := make([]byte, PAGE_SIZE)
+
+	binary.LittleEndian.PutUint16(buf[13:15], uint16(len(n.Keys)))
+	binary.LittleEndian.PutUint16(buf[15:17], uint16(len(n.children)))
+	offset := nodeHeaderSize
+
+	for _, child := range n.children {
+		binary.LittleEndian.PutUint64(buf[offset:offset+8], child)
+		offset += 8
+	}
+
+	for i, key := range n.Keys {
+		binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(len(key)))
+		offset += 2
+		offset += copy(buf[offset:], key)
+
+		if n.typ != NODE_TYPE_LEAF {
+			continue
+		}
+
+		binary.LittleEndian.PutUint32(buf[offset:offset+4], uint32(len(n.values[i])))
+		offset += 4
+		offset += copy(buf[offset:], n.values[i])
+	}
+
+	return buf, nil
+}
+
+func (n *Node) decode(buf []byte) error {
+	if n.typ != NODE_TYPE_LEAF && n.typ != NODE_TYPE_INTERNAL {
+		return fmt.Errorf("page %d has unknown node type %d", n.pgid, n.typ)
+	}
+
+	keys := int(binary.LittleEndian.Uint16(buf[13:15]))
+	children := int(binary.LittleEndian.Uint16(buf[15:17]))
+	offset := nodeHeaderSize
+
+	if offset+children*8 > len(buf) {
+		return fmt.Errorf("page %d is corrupted", n.pgid)
+	}
+
+	n.children = make([]uint64, children)
+	for i := range n.children {
+		n.children[i] = binary.LittleEndian.Uint64(buf[offset : offset+8])
+		offset += 8
+	}
+
+	n.Keys = make([][]byte, keys)
+	if n.typ == NODE_TYPE_LEAF {
+		n.values = make([][]byte, keys)
+	}
+
+	for i := range n.Keys {
+		if offset+2 > len(buf) {
+			return fmt.Errorf("page %d is corrupted", n.pgid)
+		}
+		size := int(binary.LittleEndian.Uint16(buf[offset : offset+2]))
+		offset += 2
+
+		if offset+size > len(buf) {
+			return fmt.Errorf("page %d is corrupted", n.pgid)
+		}
+		n.Keys[i] = append([]byte{}, buf[offset:offset+size]...)
+		offset += size
+
+		if n.typ != NODE_TYPE_LEAF {
+			continue
+		}
+
+		if offset+4 > len(buf) {
+			return fmt.Errorf("page %d is corrupted", n.pgid)
+		}
+		size = int(binary.LittleEndian.Uint32(buf[offset : offset+4]))
+		offset += 4
+
+		if offset+size > len(buf) {
+			return fmt.Errorf("page %d is corrupted", n.pgid)
+		}
+		n.values[i] = append([]byte{}, buf[offset:offset+size]...)
+		offset += size
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// PageInfo describes a page as it is stored in the file
+type PageInfo struct {
+	ID       uint64
+	Type     string   // meta, internal, leaf, freelist, or empty for a page never written
+	Free     bool     // the page is in the freelist, the pages holding the freelist are not free
+	Bucket   string   // bucket whose tree holds the page
+	Parent   uint64   // parent page of a node in the tree of its bucket
+	Keys     int      // keys of a node, buckets of the meta page or ids of a freelist page
+	Children []uint64 // child pages of an internal node
+	Next     uint64   // next page of the freelist chain
+	Used     int      // bytes holding data, the header included
+	Size     int      // bytes of the page
+	Err      error    // why the page could not be verified or decoded
+	Data     []byte   // raw bytes of the page
+}
+
+var pageTypeNames = map[uint8]string{
+	NODE_TYPE_INTERNAL: "internal",
+	NODE_TYPE_LEAF:     "leaf",
+	PAGE_TYPE_FREELIST: "freelist",
+	PAGE_TYPE_META:     "meta",
+}
+
+// Page reads the page pgid from the file and decodes it. problems with the
+// content of the page are reported in PageInfo.Err so broken pages can
+// still be looked at
+func (db *DB) Page(pgid uint64) (*PageInfo, error) {
+	var info *PageInfo
+	err := db.View(func(tx *Tx) error {
+		if pgid > db.meta.pgid {
+			return fmt.Errorf("page %d is out of the file, last page is %d", pgid, db.meta.pgid)
+		}
+
+		var err error
+		info, err = db.pageInfo(pgid, db.pageOwners())
+		return err
+	})
+
+	return info, err
+}
+
+// Pages reads and decodes every page of the file, see Page
+func (db *DB) Pages() ([]*PageInfo, error) {
+	var pages []*PageInfo
+	err := db.View(func(tx *Tx) error {
+		owners := db.pageOwners()
+		for pgid := uint64(0); pgid <= db.meta.pgid; pgid++ {
+			info, err := db.pageInfo(pgid, owners)
+			if err != nil {
+				return err
+			}
+
+			pages = append(pages, info)
+		}
+
+		return nil
+	})
+
+	return pages, err
+}
+
+// ReadPages reads and decodes every page of the file at path without
+// opening the database, so it works on files Open refuses. the meta page is
+// not trusted, pages are not told apart as free and have no bucket
+func ReadPages(path string) ([]*PageInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	count := int64(1)
+	if stat.Size() > DB_HEADER {
+		count += (stat.Size() - DB_HEADER + PAGE_SIZE - 1) / PAGE_SIZE
+	}
+
+	db := &DB{file: file, path: path, meta: &Meta{}}
+
+	// the meta page shown is the copy Open would pick, or the first one
+	if meta, err := db.readMeta(); err == nil {
+		db.meta.txid = meta.txid
+	}
+
+	var pages []*PageInfo
+	for pgid := uint64(0); pgid < uint64(count); pgid++ {
+		info, err := db.pageInfo(pgid, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		pages = append(pages, info)
+	}
+
+	return pages, nil
+}
+
+func (db *DB) pageInfo(pgid uint64, owners map[uint64]pageOwner) (*PageInfo, error) {
+	size := PAGE_SIZE
+	if pgid == 0 {
+		size = META_PAGE_SIZE
+	}
+
+	info := &PageInfo{
+		ID:     pgid,
+		Size:   size,
+		Bucket: owners[pgid].bucket,
+		Parent: owners[pgid].parent,
+		Data:   make([]byte, size),
+	}
+
+	offset := pageOffset(pgid)
+	if pgid == 0 {
+		offset = metaOffset(db.meta.txid)
+	}
+
+	_, err := db.file.ReadAt(info.Data, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// the freelist is sorted
+	i := sort.Search(len(db.meta.freelist), func(i int) bool { return db.meta.freelist[i] >= pgid })
+	info.Free = i < len(db.meta.freelist) && db.meta.freelist[i] == pgid
+
+	buf := info.Data
+	if bytes.Equal(buf[:pageHeaderSize], make([]byte, pageHeaderSize)) {
+		info.Type = "empty"
+		return info, nil
+	}
+
+	info.Type = pageTypeNames[buf[8]]
+	switch {
+	case info.Type == "":
+		info.Type = "unknown"
+		info.Err = fmt.Errorf("page %d has unknown type %d", pgid, buf[8])
+	case binary.LittleEndian.Uint32(buf[9:13]) != pageChecksum(buf):
+		info.Err = ErrChecksumMismatch{PageID: pgid}
+	case binary.LittleEndian.Uint64(buf[0:8]) != pgid:
+		info.Err = fmt.Errorf("page %d holds page %d", pgid, binary.LittleEndian.Uint64(buf[0:8]))
+	}
+
+	switch buf[8] {
+	case PAGE_TYPE_META:
+		meta, err := decodeMeta(buf)
+		if err != nil {
+			if info.Err == nil {
+				info.Err = err
+			}
+			break
+		}
+
+		info.Keys = len(meta.buckets)
+		info.Used = pageHeaderSize + metaHeaderSize
+		for _, record := range meta.buckets {
+			info.Used += record.size()
+		}
+	case PAGE_TYPE_FREELIST:
+		info.Next = binary.LittleEndian.Uint64(buf[13:21])
+		info.Keys = int(binary.LittleEndian.Uint16(buf[21:23]))
+		info.Used = freelistHeaderSize + info.Keys*8
+	case NODE_TYPE_INTERNAL, NODE_TYPE_LEAF:
+		node := newNode(&Bucket{bucket: newBucket(db, info.Bucket, 0)}, pgid, buf[8])
+		if err := node.decode(buf); err != nil {
+			if info.Err == nil {
+				info.Err = err
+			}
+			break
+		}
+
+		info.Keys = len(node.Keys)
+		info.Children = node.children
+		info.Used = node.size()
+	}
+
+	return info, nil
+}
+
+// pageOwner is the bucket whose tree holds a page and the parent of the
+// page in the tree
+type pageOwner struct {
+	bucket string
+	parent uint64
+}
+
+// pageOwners walks the tree of every bucket on disk and returns the owner
+// of each page it reaches. checksums are not verified, so pages below a
+// corrupted page are still found
+func (db *DB) pageOwners() map[uint64]pageOwner {
+	owners := make(map[uint64]pageOwner)
+
+	var walk func(name string, pgid uint64, parent uint64)
+	walk = func(name string, pgid uint64, parent uint64) {
+		if _, ok := owners[pgid]; ok || pgid == 0 || pgid > db.meta.pgid {
+			return
+		}
+		owners[pgid] = pageOwner{bucket: name, parent: parent}
+
+		buf := make([]byte, PAGE_SIZE)
+		if _, err := db.file.ReadAt(buf, pageOffset(pgid)); err != nil {
+			return
+		}
+
+		node := newNode(&Bucket{bucket: newBucket(db, name, 0)}, pgid, buf[8])
+		if err := node.decode(buf); err != nil {
+			return
+		}
+
+		for _, child := range node.children {
+			walk(name, child, pgid)
+		}
+	}
+
+	for _, record := range db.meta.buckets {
+		walk(record.name, record.rootpage, 0)
+	}
+
+	return owners
+}
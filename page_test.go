@@ -0,0 +1,267 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// flipByte corrupts one byte of the page on disk
+func flipByte(t *testing.T, path string, pgid uint64, offset int64) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	buf := make([]byte, 1)
+	if _, err := file.ReadAt(buf, pageOffset(pgid)+offset); err != nil {
+		t.Fatal(err)
+	}
+
+	buf[0] ^= 0xff
+	if _, err := file.WriteAt(buf, pageOffset(pgid)+offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPageChecksumMismatch(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "user_emails")
+	for i := 0; i < 10; i++ {
+		if err := bucket.Put([]byte(fmt.Sprintf("user%d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := bucket.root
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	flipByte(t, path, root, PAGE_SIZE-1)
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	_, err = mustBucket(t, db, "user_emails").Get([]byte("user1"))
+
+	var mismatch ErrChecksumMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected checksum mismatch but got %v", err)
+	}
+
+	if mismatch.PageID != root {
+		t.Fatalf("expected mismatch on page %d but got %d", root, mismatch.PageID)
+	}
+
+	found := false
+	for _, problem := range db.Check() {
+		if errors.As(problem, &mismatch) {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatal("expected Check to report the checksum mismatch")
+	}
+}
+
+func TestPageNotWritten(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "user_emails")
+	for i := 0; i < 10; i++ {
+		if err := bucket.Put([]byte(fmt.Sprintf("user%d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leaf := bucket.node(bucket.root)
+	for leaf.typ != NODE_TYPE_LEAF {
+		leaf = leaf.child(leaf.children[0])
+	}
+	pgid := leaf.pgid
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a zeroed page looks like a page never written, it is not an empty leaf
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt(make([]byte, PAGE_SIZE), pageOffset(pgid)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	db, err = Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if _, err := mustBucket(t, db, "user_emails").Get([]byte("user0")); !errors.Is(err, errPageNotWritten) {
+		t.Fatalf("expected page %d not to be written but got %v", pgid, err)
+	}
+
+	found := false
+	for _, problem := range db.Check() {
+		if strings.Contains(problem.Error(), "was never written") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected Check to report the page")
+	}
+}
+
+func TestMetaChecksumMismatch(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "user_emails")
+	if err := bucket.Put([]byte("user"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("user"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+
+	txid := db.meta.txid
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a commit cut short while writing the meta page leaves the copy of
+	// the previous one
+	flipByte(t, path, 0, metaOffset(txid)+pageHeaderSize)
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := mustBucket(t, db, "user_emails").Get([]byte("user")); err != nil || string(value) != "x" {
+		t.Fatalf("expected the value of the previous commit but got %q, %v", value, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	flipByte(t, path, 0, metaOffset(txid-1)+pageHeaderSize)
+
+	_, err = Open(path, nil)
+
+	var mismatch ErrChecksumMismatch
+	if !errors.As(err, &mismatch) || mismatch.PageID != 0 {
+		t.Fatalf("expected checksum mismatch on the meta page but got %v", err)
+	}
+}
+
+func TestDBPages(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "user_emails")
+	for i := 0; i < 10; i++ {
+		if err := bucket.Put([]byte(fmt.Sprintf("user%d", i)), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bucket.DeleteRange([]byte("user0"), []byte("user5")); err != nil {
+		t.Fatal(err)
+	}
+
+	root := bucket.root
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	flipByte(t, path, root, PAGE_SIZE-1)
+
+	db, err = Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	pages, err := db.Pages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pages) != int(db.meta.pgid)+1 {
+		t.Fatalf("expected %d pages but got %d", db.meta.pgid+1, len(pages))
+	}
+
+	if pages[0].Type != "meta" || pages[0].Keys != 1 || pages[0].Err != nil {
+		t.Fatalf("unexpected meta page %s with %d buckets, %v", pages[0].Type, pages[0].Keys, pages[0].Err)
+	}
+
+	free := 0
+	for _, page := range pages {
+		if page.Free {
+			free++
+		}
+		if page.Used > page.Size {
+			t.Fatalf("page %d uses %d of %d bytes", page.ID, page.Used, page.Size)
+		}
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free != stats.FreePageN || len(db.meta.chain) == 0 {
+		t.Fatalf("expected the %d free pages of the stats but got %d", stats.FreePageN, free)
+	}
+
+	// the root is still decoded although its checksum does not match
+	page, err := db.Page(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mismatch ErrChecksumMismatch
+	if page.Type != "internal" || page.Bucket != "user_emails" || len(page.Children) != page.Keys+1 || !errors.As(page.Err, &mismatch) {
+		t.Fatalf("unexpected root page %s %s %v %v", page.Type, page.Bucket, page.Children, page.Err)
+	}
+
+	leaf, err := db.Page(page.Children[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Parent != root || leaf.Bucket != "user_emails" {
+		t.Fatalf("unexpected child page with parent %d in bucket %s", leaf.Parent, leaf.Bucket)
+	}
+
+	if _, err := db.Page(db.meta.pgid + 1); err == nil {
+		t.Fatal("expected a page out of the file to fail")
+	}
+}
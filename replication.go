@@ -0,0 +1,545 @@
+package kvdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// a follower replicates a primary over a stream. it starts by sending the
+// sequence of the last change it applied, then the primary sends frames
+//
+//	snapshot:        sequence of the change log the snapshot is at
+//	snapshot bucket: bucket name, bucket sequence
+//	snapshot key:    key, value, of the last snapshot bucket
+//	snapshot end:    nothing
+//	tx:              number of changes, then sequence and change for each
+//	tx part:         like tx, a transaction continues in the next frame
+//
+// a frame is its type, its length as a uvarint and its payload, at most
+// maxFrameSize bytes. transactions too large for a frame are sent in parts,
+// the last one is a tx frame. a snapshot
+// is only sent to a new follower, which may miss keys written before the
+// change log was enabled, when the changes the follower misses were
+// truncated from the change log, or when the follower is ahead of the primary
+
+const (
+	frameHello          = 0x01
+	frameSnapshot       = 0x02
+	frameSnapshotBucket = 0x03
+	frameSnapshotKey    = 0x04
+	frameSnapshotEnd    = 0x05
+	frameTx             = 0x06
+	frameTxPart         = 0x07
+)
+
+// maxFrameSize is the largest payload of a frame, a peer sending a larger
+// one is disconnected before the payload is read
+const maxFrameSize = 4 << 20
+
+// replicateBatchSize is about how many changes the primary reads from the
+// change log at once, transactions are never split
+const replicateBatchSize = 1000
+
+// the follower keeps the sequence of the last change it applied as the
+// sequence of an internal bucket, so it is committed with the changes
+const replicationBucketName = internalBucketPrefix + "replication"
+
+// ErrChangeLogDisabled is returned by Replicate when the primary was not
+// opened with Config.ChangeLog
+var ErrChangeLogDisabled = errors.New("change log disabled")
+
+// Replicate sends the changes committed on primary to the follower at the
+// other end of rw, which runs Follow. the follower is first brought up to
+// date, with a snapshot if it is new or the changes it misses are not in the
+// change log anymore, then every transaction is sent after it commits.
+//
+// the primary must be opened with Config.ChangeLog. Replicate serves one
+// follower until it disconnects, writing to rw fails or primary is closed,
+// changes must not be truncated before every follower received them. rw is
+// read until it is closed, close it once Replicate returns
+func Replicate(primary *DB, rw io.ReadWriter) error {
+	if !primary.config.ChangeLog {
+		return ErrChangeLogDisabled
+	}
+
+	r := bufio.NewReader(rw)
+	w := bufio.NewWriter(rw)
+
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+
+	seq, n := binary.Uvarint(payload)
+	if typ != frameHello || n <= 0 {
+		return fmt.Errorf("replication: expected hello from the follower")
+	}
+
+	// the follower sends nothing after its hello, reading only returns
+	// once it disconnects
+	gone := make(chan error, 1)
+	go func() {
+		_, err := r.ReadByte()
+		if err == nil {
+			err = fmt.Errorf("replication: unexpected data from the follower")
+		}
+		gone <- err
+	}()
+
+	// watch before reading the change log so no commit is missed, events
+	// only wake the loop up, the changes are read from the log
+	events, cancel := primary.Watch("", nil)
+	defer func() { cancel() }()
+
+	var last uint64
+	primary.View(func(tx *Tx) error {
+		if record := primary.meta.record(changeLogBucketName); record != nil {
+			last = record.sequence
+		}
+		return nil
+	})
+
+	// a follower ahead of the primary applied changes of another primary
+	snapshot := seq == 0 || seq > last
+
+	for {
+		var next uint64
+		if !snapshot {
+			next, err = sendChanges(primary, w, seq)
+		}
+		if snapshot || errors.Is(err, ErrChangesTruncated) {
+			next, err = sendSnapshot(primary, w)
+			snapshot = false
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		// the batch was full, there may be more changes already
+		if next != seq {
+			seq = next
+			continue
+		}
+
+		select {
+		case _, ok := <-events:
+			if ok {
+				// drain the events of the commits the next read covers
+				for len(events) > 0 {
+					<-events
+				}
+				continue
+			}
+		case <-primary.closing:
+			return nil
+		case err := <-gone:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		select {
+		case <-primary.closing:
+			return nil
+		default:
+		}
+
+		// the watcher fell behind and was dropped
+		events, cancel = primary.Watch("", nil)
+	}
+}
+
+// sendChanges writes the transactions after seq found in the change log and
+// returns the sequence of the last change written
+func sendChanges(primary *DB, w io.Writer, seq uint64) (uint64, error) {
+	// changes are read before they are sent, so commits do not wait for
+	// the follower
+	var changes []Event
+	err := primary.ChangesSince(seq, func(event Event) bool {
+		if len(changes) >= replicateBatchSize && event.TxID != changes[len(changes)-1].TxID {
+			return false
+		}
+
+		changes = append(changes, event)
+		return true
+	})
+	if err != nil {
+		return seq, err
+	}
+
+	for len(changes) > 0 {
+		i := 1
+		for i < len(changes) && changes[i].TxID == changes[0].TxID {
+			i++
+		}
+
+		if err := sendTx(w, changes[:i]); err != nil {
+			return seq, err
+		}
+
+		seq = changes[i-1].Seq
+		changes = changes[i:]
+	}
+
+	return seq, nil
+}
+
+// sendTx writes the changes of a transaction, in parts if they do not fit
+// in a frame
+func sendTx(w io.Writer, changes []Event) error {
+	var records [][]byte
+	size := 0
+	for i, event := range changes {
+		record := binary.AppendUvarint(nil, event.Seq)
+		record = appendBytes(record, encodeChange(event))
+
+		// the count of a frame takes at most 10 bytes
+		if len(records) > 0 && size+len(record)+binary.MaxVarintLen64 > maxFrameSize {
+			if err := writeFrame(w, frameTxPart, encodeTx(records)); err != nil {
+				return err
+			}
+			records, size = nil, 0
+		}
+
+		records = append(records, record)
+		size += len(record)
+
+		if i == len(changes)-1 {
+			return writeFrame(w, frameTx, encodeTx(records))
+		}
+	}
+
+	return nil
+}
+
+func encodeTx(records [][]byte) []byte {
+	payload := binary.AppendUvarint(nil, uint64(len(records)))
+	for _, record := range records {
+		payload = append(payload, record...)
+	}
+	return payload
+}
+
+// sendSnapshot writes every user bucket of the primary. the snapshot is read
+// from a copy made with CopyFile, so commits do not wait for the follower.
+// it returns the sequence of the change log the snapshot is at
+func sendSnapshot(primary *DB, w io.Writer) (uint64, error) {
+	file, err := os.CreateTemp(filepath.Dir(primary.path), filepath.Base(primary.path)+".snapshot-*")
+	if err != nil {
+		return 0, err
+	}
+
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+
+	if err := primary.CopyFile(path, 0600); err != nil {
+		return 0, err
+	}
+
+	snapshot, err := Open(path, &Config{TTLSweepInterval: -1})
+	if err != nil {
+		return 0, err
+	}
+
+	defer snapshot.Close()
+
+	var seq uint64
+	err = snapshot.View(func(tx *Tx) (err error) {
+		defer recoverReadError(&err)
+
+		if record := snapshot.meta.record(changeLogBucketName); record != nil {
+			seq = record.sequence
+		}
+
+		if err := writeFrame(w, frameSnapshot, binary.AppendUvarint(nil, seq)); err != nil {
+			return err
+		}
+
+		for _, name := range tx.Buckets() {
+			b := tx.bucket(name, false)
+
+			payload := appendBytes(nil, []byte(name))
+			payload = binary.AppendUvarint(payload, snapshot.meta.record(name).sequence)
+			if err := writeFrame(w, frameSnapshotBucket, payload); err != nil {
+				return err
+			}
+
+			b.node(b.root).scan(func(key []byte, value []byte) bool {
+				// expired keys are removed on the primary and then on the
+				// follower by the change of the sweep
+				err = writeFrame(w, frameSnapshotKey, appendBytes(appendBytes(nil, key), value))
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return writeFrame(w, frameSnapshotEnd, nil)
+	})
+
+	return seq, err
+}
+
+// Follow applies the changes sent by Replicate from the primary at the other
+// end of rw to follower, each transaction of the primary in a transaction of
+// its own. a snapshot replaces every user bucket of the follower, so the
+// follower must not be written to by anything else. it returns nil once rw
+// reaches EOF, close rw to stop following.
+//
+// expiries set with PutWithTTL are not replicated, the keys are removed
+// from the follower when the primary sweeps them
+func Follow(follower *DB, rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+
+	applied, err := follower.AppliedSeq()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFrame(rw, frameHello, binary.AppendUvarint(nil, applied)); err != nil {
+		return err
+	}
+
+	for {
+		typ, payload, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameTx:
+			err = follower.Update(func(tx *Tx) error {
+				return applyTx(tx, payload)
+			})
+		case frameTxPart:
+			err = follower.Update(func(tx *Tx) error {
+				return applyTxParts(tx, r, payload)
+			})
+		case frameSnapshot:
+			err = follower.Update(func(tx *Tx) error {
+				return applySnapshot(tx, r, payload)
+			})
+		default:
+			err = fmt.Errorf("replication: unexpected frame %d", typ)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// AppliedSeq returns the sequence in the change log of the primary of the
+// last change Follow applied, 0 if the database never followed a primary
+func (db *DB) AppliedSeq() (uint64, error) {
+	var seq uint64
+	err := db.View(func(tx *Tx) error {
+		if record := db.meta.record(replicationBucketName); record != nil {
+			seq = record.sequence
+		}
+		return nil
+	})
+
+	return seq, err
+}
+
+// setApplied records seq as the last change applied by the transaction
+func (tx *Tx) setApplied(seq uint64) {
+	tx.bucket(replicationBucketName, true)
+	tx.db.meta.record(replicationBucketName).sequence = seq
+}
+
+func applyTx(tx *Tx, payload []byte) (err error) {
+	defer recoverReadError(&err)
+
+	invalid := fmt.Errorf("replication: invalid transaction")
+
+	count, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return invalid
+	}
+	payload = payload[n:]
+
+	applied := tx.db.meta.record(replicationBucketName)
+	for i := uint64(0); i < count; i++ {
+		seq, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return invalid
+		}
+
+		var data []byte
+		if data, payload, err = readBytes(payload[n:]); err != nil {
+			return fmt.Errorf("%v, change %d: %w", invalid, seq, err)
+		}
+
+		var event Event
+		if event, _, err = decodeChange(seq, data); err != nil {
+			return err
+		}
+
+		// the change was applied before the follower reconnected
+		if applied != nil && seq <= applied.sequence {
+			continue
+		}
+
+		b := tx.Bucket(event.Bucket)
+		b.forget(event.Key)
+		switch event.Type {
+		case EventPut:
+			b.put(event.Key, event.After)
+		case EventDelete:
+			b.delete(event.Key)
+		default:
+			return fmt.Errorf("replication: unknown change type %d", event.Type)
+		}
+
+		tx.setApplied(seq)
+	}
+
+	return nil
+}
+
+// applyTxParts applies a transaction sent in parts, the first part with
+// payload was read already
+func applyTxParts(tx *Tx, r *bufio.Reader, payload []byte) error {
+	for {
+		if err := applyTx(tx, payload); err != nil {
+			return err
+		}
+
+		typ, next, err := readFrame(r)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameTxPart:
+			payload = next
+		case frameTx:
+			return applyTx(tx, next)
+		default:
+			return fmt.Errorf("replication: unexpected frame %d in a transaction", typ)
+		}
+	}
+}
+
+// applySnapshot empties every user bucket and fills them with the snapshot
+// read from r, the snapshot frame with payload was read already
+func applySnapshot(tx *Tx, r *bufio.Reader, payload []byte) (err error) {
+	defer recoverReadError(&err)
+
+	invalid := fmt.Errorf("replication: invalid snapshot")
+
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return invalid
+	}
+
+	for _, name := range tx.Buckets() {
+		b := tx.Bucket(name)
+		b.forgetRange(nil, nil)
+		b.deleteRange(nil, nil)
+	}
+
+	var b *Bucket
+	for {
+		typ, payload, err := readFrame(r)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameSnapshotBucket:
+			name, payload, err := readBytes(payload)
+			if err != nil {
+				return fmt.Errorf("%v, bucket name: %w", invalid, err)
+			}
+
+			sequence, n := binary.Uvarint(payload)
+			if n <= 0 {
+				return invalid
+			}
+
+			b = tx.Bucket(string(name))
+			tx.db.meta.record(b.name).sequence = sequence
+		case frameSnapshotKey:
+			if b == nil {
+				return invalid
+			}
+
+			key, payload, err := readBytes(payload)
+			if err != nil {
+				return fmt.Errorf("%v, key: %w", invalid, err)
+			}
+
+			value, _, err := readBytes(payload)
+			if err != nil {
+				return fmt.Errorf("%v, value: %w", invalid, err)
+			}
+
+			b.put(key, value)
+		case frameSnapshotEnd:
+			tx.setApplied(seq)
+			return nil
+		default:
+			return invalid
+		}
+	}
+}
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	buf := binary.AppendUvarint([]byte{typ}, uint64(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("replication: frame of %d bytes is larger than %d", size, maxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+
+	return typ, payload, nil
+}
+
+// unexpectedEOF turns EOF into ErrUnexpectedEOF, a frame stopped in the middle
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,281 @@
+package kvdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// follow connects follower to primary with a pipe, the returned function
+// disconnects them
+func follow(t *testing.T, primary *DB, follower *DB) func() {
+	primaryConn, followerConn := net.Pipe()
+
+	// Replicate returns once it writes to the closed pipe or the primary
+	// is closed
+	go Replicate(primary, primaryConn)
+
+	followed := make(chan error, 1)
+	go func() { followed <- Follow(follower, followerConn) }()
+
+	return func() {
+		primaryConn.Close()
+		if err := <-followed; err != nil {
+			t.Fatal(err)
+		}
+		followerConn.Close()
+	}
+}
+
+// waitApplied waits for follower to apply the changes of primary up to seq
+func waitApplied(t *testing.T, follower *DB, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		applied, err := follower.AppliedSeq()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied == seq {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the follower to apply %d but it applied %d", seq, applied)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// lastChange returns the sequence of the last change after seq
+func lastChange(t *testing.T, db *DB, seq uint64) uint64 {
+	if err := db.ChangesSince(seq, func(event Event) bool { seq = event.Seq; return true }); err != nil {
+		t.Fatal(err)
+	}
+	return seq
+}
+
+func dump(t *testing.T, db *DB) string {
+	var s string
+	for _, name := range db.Buckets() {
+		sequence, err := mustBucket(t, db, name).Sequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s += fmt.Sprintf("%s %d:", name, sequence)
+		mustBucket(t, db, name).Scan(func(key []byte, value []byte) bool {
+			s += fmt.Sprintf(" %s=%s", key, value)
+			return true
+		})
+		s += "\n"
+	}
+	return s
+}
+
+func TestReplicate(t *testing.T) {
+	primary, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2, ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer primary.Close()
+
+	followerPath := tempDBPath(t)
+	follower, err := Open(followerPath, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the follower starts with a snapshot, which replaces what it had
+	if err := mustBucket(t, follower, "stale").Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, primary, "users").Put([]byte("user:1"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, primary, "users").SetSequence(7); err != nil {
+		t.Fatal(err)
+	}
+
+	disconnect := follow(t, primary, follower)
+
+	err = primary.Update(func(tx *Tx) error {
+		b := tx.Bucket("users")
+		for i := 2; i <= 20; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("user:%d", i)), []byte("b")); err != nil {
+				return err
+			}
+		}
+		return b.Delete([]byte("user:1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, primary, "orders").Put([]byte("order:1"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mustBucket(t, primary, "users").DeletePrefix([]byte("user:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitApplied(t, follower, lastChange(t, primary, 0))
+
+	expected := dump(t, primary)
+	if got := dump(t, follower); got != "stale 0:\n"+expected {
+		t.Fatalf("expected the follower to hold\n%s\nbut got\n%s", expected, got)
+	}
+
+	disconnect()
+
+	// changes made while the follower is away are sent when it reconnects
+	if err := mustBucket(t, primary, "users").Put([]byte("user:30"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+
+	disconnect = follow(t, primary, follower)
+	waitApplied(t, follower, lastChange(t, primary, 0))
+	disconnect()
+
+	// the follower keeps its position across restarts and needs a snapshot
+	// once the changes it misses were truncated
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, primary, "orders").Put([]byte("order:2"), []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	truncated := lastChange(t, primary, 0)
+	if err := primary.TruncateChanges(truncated); err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, primary, "users").Delete([]byte("user:30")); err != nil {
+		t.Fatal(err)
+	}
+
+	follower, err = Open(followerPath, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer follower.Close()
+
+	disconnect = follow(t, primary, follower)
+	defer disconnect()
+
+	waitApplied(t, follower, lastChange(t, primary, truncated))
+
+	expected = dump(t, primary)
+	if got := dump(t, follower); got != "stale 0:\n"+expected {
+		t.Fatalf("expected the follower to hold\n%s\nbut got\n%s", expected, got)
+	}
+
+	if errs := follower.Check(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+}
+
+func TestReplicateWithoutChangeLog(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	primaryConn, followerConn := net.Pipe()
+	defer followerConn.Close()
+
+	if err := Replicate(db, primaryConn); err != ErrChangeLogDisabled {
+		t.Fatalf("expected ErrChangeLogDisabled but got %v", err)
+	}
+}
+
+func TestReplicateLargeTx(t *testing.T) {
+	primary, err := Open(tempDBPath(t), &Config{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer primary.Close()
+
+	follower, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer follower.Close()
+
+	disconnect := follow(t, primary, follower)
+	defer disconnect()
+
+	// the transaction does not fit in a frame and is sent in parts
+	value := bytes.Repeat([]byte("x"), 2000)
+	err = primary.Update(func(tx *Tx) error {
+		b := tx.Bucket("numbers")
+		for i := 0; i < maxFrameSize/len(value)+100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", i)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitApplied(t, follower, lastChange(t, primary, 0))
+
+	if dump(t, follower) != dump(t, primary) {
+		t.Fatal("expected the follower to hold the keys of the primary")
+	}
+}
+
+func TestReplicateFollowerDisconnects(t *testing.T) {
+	primary, err := Open(tempDBPath(t), &Config{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer primary.Close()
+
+	follower, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer follower.Close()
+
+	primaryConn, followerConn := net.Pipe()
+	defer primaryConn.Close()
+
+	replicated := make(chan error, 1)
+	go func() { replicated <- Replicate(primary, primaryConn) }()
+	go Follow(follower, followerConn)
+
+	if err := mustBucket(t, primary, "numbers").Put([]byte("1"), []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	waitApplied(t, follower, lastChange(t, primary, 0))
+
+	// Replicate is idle, it notices the follower is gone without writing
+	followerConn.Close()
+
+	select {
+	case err := <-replicated:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Replicate to return once the follower disconnected")
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	frame := binary.AppendUvarint([]byte{frameTx}, maxFrameSize+1)
+	if _, _, err := readFrame(bufio.NewReader(bytes.NewReader(frame))); err == nil {
+		t.Fatal("expected a frame larger than maxFrameSize to be rejected")
+	}
+}
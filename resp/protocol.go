@@ -0,0 +1,141 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// clients send commands as arrays of bulk strings
+//
+//	*2\r\n$3\r\nGET\r\n$4\r\nuser\r\n
+//
+// or as inline commands, a line of arguments separated by spaces, which is
+// what people type in telnet
+
+var errProtocol = errors.New("Protocol error")
+
+// readCommand reads the arguments of the next command, the command name
+// included. empty inline lines are skipped. commands with more than maxArgs
+// arguments or an argument longer than maxBulkLen are a protocol error
+func readCommand(r *bufio.Reader, maxArgs int, maxBulkLen int) ([][]byte, error) {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '*' {
+			if args := bytes.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > maxArgs {
+			return nil, errProtocol
+		}
+		if n <= 0 {
+			continue
+		}
+
+		// the arguments are allocated as they arrive, not as announced
+		var args [][]byte
+		for i := 0; i < n; i++ {
+			arg, err := readBulk(r, maxBulkLen)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+
+		return args, nil
+	}
+}
+
+func readBulk(r *bufio.Reader, maxBulkLen int) ([]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '$' {
+		return nil, errProtocol
+	}
+
+	size, err := strconv.Atoi(string(line[1:]))
+	if err != nil || size < 0 || size > maxBulkLen {
+		return nil, errProtocol
+	}
+
+	// the buffer grows as the bytes arrive, a client announcing a large
+	// bulk it does not send cannot make the server allocate it
+	buf, err := io.ReadAll(io.LimitReader(r, int64(size)+2))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < size+2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return nil, errProtocol
+	}
+
+	return buf[:size], nil
+}
+
+// readLine reads a line ending with \r\n, or \n for inline commands, and
+// returns it without the line ending
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+
+	return append([]byte{}, line...), nil
+}
+
+// reply is the answer to a command
+type reply any
+
+type (
+	simple     string
+	errorReply string
+	integer    int64
+	bulk       []byte // nil is the null reply
+	array      []reply
+)
+
+var ok = simple("OK")
+
+func writeReply(w *bufio.Writer, r reply) {
+	switch r := r.(type) {
+	case simple:
+		w.WriteString("+" + string(r) + "\r\n")
+	case errorReply:
+		w.WriteString("-" + string(r) + "\r\n")
+	case integer:
+		w.WriteString(":" + strconv.FormatInt(int64(r), 10) + "\r\n")
+	case bulk:
+		if r == nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		w.WriteString("$" + strconv.Itoa(len(r)) + "\r\n")
+		w.Write(r)
+		w.WriteString("\r\n")
+	case array:
+		w.WriteString("*" + strconv.Itoa(len(r)) + "\r\n")
+		for _, item := range r {
+			writeReply(w, item)
+		}
+	}
+}
@@ -0,0 +1,566 @@
+// Package resp serves a kvdb database over a subset of the Redis protocol,
+// so stock Redis clients can read and write it. every bucket is a Redis
+// database, SELECT picks the bucket the other commands work on, by name or
+// by number. the supported commands are
+//
+//	PING, ECHO, QUIT, SELECT, GET, SET with EX, PX, NX and XX, DEL,
+//	EXISTS, SCAN with prefix MATCH patterns and COUNT, MULTI, EXEC, DISCARD
+//
+// commands queued by MULTI are run by EXEC in one transaction, so they are
+// applied atomically
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ahmedash95/kvdb"
+)
+
+// DefaultBucket is the bucket new connections work on, like the database 0
+// of Redis
+const DefaultBucket = "0"
+
+// DefaultMaxArgs and DefaultMaxBulkLen are the limits of the commands
+// NewServer sets, keys and values are stored in pages so they are much
+// smaller than a bulk anyway
+const (
+	DefaultMaxArgs    = 64 * 1024
+	DefaultMaxBulkLen = 1 << 20
+)
+
+// ErrServerClosed is returned by Serve after Close was called
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server serves a database to Redis clients
+type Server struct {
+	// MaxArgs and MaxBulkLen are how many arguments a command may have and
+	// how long each may be, clients going over are sent a protocol error
+	// and disconnected. set them before calling Serve
+	MaxArgs    int
+	MaxBulkLen int
+
+	db *kvdb.DB
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+func NewServer(db *kvdb.DB) *Server {
+	return &Server{
+		MaxArgs:    DefaultMaxArgs,
+		MaxBulkLen: DefaultMaxBulkLen,
+		db:         db,
+		listeners:  make(map[net.Listener]bool),
+		conns:      make(map[net.Conn]bool),
+	}
+}
+
+// Serve accepts connections on l and serves each of them in a goroutine
+// until Close is called. it always returns an error, ErrServerClosed after
+// Close
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			delete(s.listeners, l)
+			if s.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes every connection and waits for the
+// commands being run to finish. it does not close the database
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return nil
+}
+
+// session is the state of a connection
+type session struct {
+	bucket  string
+	multi   bool       // commands are queued until EXEC
+	queue   [][][]byte // commands queued since MULTI
+	aborted bool       // a command could not be queued, EXEC fails
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
+		conn.Close()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	sess := &session{bucket: DefaultBucket}
+
+	for {
+		args, err := readCommand(r, s.MaxArgs, s.MaxBulkLen)
+		if err == errProtocol {
+			writeReply(w, errorReply("ERR "+err.Error()))
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		name := strings.ToUpper(string(args[0]))
+		writeReply(w, s.handle(sess, name, args))
+
+		// answer every command already sent before waiting for the next
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+
+		if name == "QUIT" {
+			w.Flush()
+			return
+		}
+	}
+}
+
+// handle runs a command, or queues it inside MULTI
+func (s *Server) handle(sess *session, name string, args [][]byte) reply {
+	switch name {
+	case "QUIT":
+		return ok
+	case "MULTI":
+		if sess.multi {
+			return errorReply("ERR MULTI calls can not be nested")
+		}
+		sess.multi = true
+		return ok
+	case "DISCARD":
+		if !sess.multi {
+			return errorReply("ERR DISCARD without MULTI")
+		}
+		sess.reset()
+		return ok
+	case "EXEC":
+		if !sess.multi {
+			return errorReply("ERR EXEC without MULTI")
+		}
+		defer sess.reset()
+
+		if sess.aborted {
+			return errorReply("EXECABORT Transaction discarded because of previous errors.")
+		}
+		return s.exec(sess)
+	}
+
+	cmd, invalid := lookup(name, args)
+	if invalid != nil {
+		if sess.multi {
+			sess.aborted = true
+		}
+		return invalid
+	}
+
+	if sess.multi {
+		sess.queue = append(sess.queue, args)
+		return simple("QUEUED")
+	}
+
+	var res reply
+	run := s.db.View
+	if cmd.write {
+		run = s.db.Update
+	}
+	if err := run(func(tx *kvdb.Tx) error {
+		res = cmd.run(tx, sess, args)
+		return nil
+	}); err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+
+	return res
+}
+
+// exec runs the queued commands in one writable transaction. like Redis, a
+// command failing does not stop the ones after it
+func (s *Server) exec(sess *session) reply {
+	var replies array
+	err := s.db.Update(func(tx *kvdb.Tx) error {
+		for _, args := range sess.queue {
+			cmd, _ := lookup(strings.ToUpper(string(args[0])), args)
+			replies = append(replies, cmd.run(tx, sess, args))
+		}
+		return nil
+	})
+	if err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+
+	return replies
+}
+
+func (sess *session) reset() {
+	sess.multi = false
+	sess.queue = nil
+	sess.aborted = false
+}
+
+type command struct {
+	arity int  // arguments with the name, -n for at least n
+	write bool // runs in a writable transaction
+	run   func(tx *kvdb.Tx, sess *session, args [][]byte) reply
+}
+
+var commands = map[string]command{
+	"PING":    {-1, false, ping},
+	"ECHO":    {2, false, echo},
+	"SELECT":  {2, false, selectBucket},
+	"GET":     {2, false, get},
+	"SET":     {-3, true, set},
+	"DEL":     {-2, true, del},
+	"EXISTS":  {-2, false, exists},
+	"SCAN":    {-2, false, scan},
+	"COMMAND": {-1, false, commandDocs},
+}
+
+// lookup finds the command and checks its number of arguments
+func lookup(name string, args [][]byte) (command, reply) {
+	cmd, found := commands[name]
+	if !found {
+		return command{}, errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		return command{}, errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	}
+
+	return cmd, nil
+}
+
+// bucket returns the bucket of the session, nil if it does not exist and
+// create is false
+func bucket(tx *kvdb.Tx, sess *session, create bool) *kvdb.Bucket {
+	if !create {
+		found := false
+		for _, name := range tx.Buckets() {
+			found = found || name == sess.bucket
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	return tx.Bucket(sess.bucket)
+}
+
+func ping(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	switch len(args) {
+	case 1:
+		return simple("PONG")
+	case 2:
+		return bulk(args[1])
+	}
+
+	return errorReply("ERR wrong number of arguments for 'ping' command")
+}
+
+func echo(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	return bulk(args[1])
+}
+
+func selectBucket(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	// names starting with a zero byte are kept by the database for itself
+	if len(args[1]) == 0 || args[1][0] == 0 {
+		return errorReply("ERR invalid bucket name")
+	}
+
+	sess.bucket = string(args[1])
+	return ok
+}
+
+func get(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	b := bucket(tx, sess, false)
+	if b == nil {
+		return bulk(nil)
+	}
+
+	value, err := b.Get(args[1])
+	if errors.Is(err, kvdb.ErrKeyNotFound) {
+		return bulk(nil)
+	}
+	if err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+
+	// the value belongs to the node, which may change once the
+	// transaction is closed
+	return bulk(append([]byte{}, value...))
+}
+
+// set supports the options
+//
+//	EX seconds, PX milliseconds: the key expires after the given time
+//	NX: only set the key if it does not exist
+//	XX: only set the key if it exists
+//
+// it replies with null when NX or XX did not let the key be set
+func set(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) || ttl != 0 {
+				return errorReply("ERR syntax error")
+			}
+
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				return errorReply("ERR invalid expire time in 'set' command")
+			}
+
+			ttl = time.Duration(n) * time.Millisecond
+			if strings.ToUpper(string(args[i])) == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+			i++
+		default:
+			return errorReply("ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return errorReply("ERR syntax error")
+	}
+
+	b := bucket(tx, sess, true)
+	if nx || xx {
+		_, err := b.Get(args[1])
+		if err != nil && !errors.Is(err, kvdb.ErrKeyNotFound) {
+			return errorReply("ERR " + err.Error())
+		}
+
+		if exists := err == nil; (nx && exists) || (xx && !exists) {
+			return bulk(nil)
+		}
+	}
+
+	var err error
+	if ttl > 0 {
+		err = b.PutWithTTL(args[1], args[2], ttl)
+	} else {
+		err = b.Put(args[1], args[2])
+	}
+	if err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+
+	return ok
+}
+
+func del(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	b := bucket(tx, sess, false)
+	if b == nil {
+		return integer(0)
+	}
+
+	var n integer
+	for _, key := range args[1:] {
+		err := b.Delete(key)
+		if errors.Is(err, kvdb.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return errorReply("ERR " + err.Error())
+		}
+		n++
+	}
+
+	return n
+}
+
+func exists(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	b := bucket(tx, sess, false)
+	if b == nil {
+		return integer(0)
+	}
+
+	var n integer
+	for _, key := range args[1:] {
+		_, err := b.Get(key)
+		if errors.Is(err, kvdb.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return errorReply("ERR " + err.Error())
+		}
+		n++
+	}
+
+	return n
+}
+
+// scan walks the keys in order. the cursor is the last key returned, so the
+// next call seeks to it instead of walking the keys before it again, keys
+// written between calls are returned if they come after it. only patterns
+// matching a prefix, like user:*, are supported
+func scan(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	after, ok := decodeCursor(string(args[1]))
+	if !ok {
+		return errorReply("ERR invalid cursor")
+	}
+
+	var prefix []byte
+	count := 10
+	for i := 2; i < len(args); i++ {
+		if i+1 == len(args) {
+			return errorReply("ERR syntax error")
+		}
+
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern := string(args[i+1])
+			literal := strings.TrimSuffix(pattern, "*")
+			if strings.ContainsAny(literal, "*?[\\") {
+				return errorReply("ERR only prefix patterns like user:* are supported")
+			}
+			if literal == pattern {
+				// a pattern without wildcards matches only itself
+				return scanExact(tx, sess, []byte(pattern))
+			}
+			prefix = []byte(literal)
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n <= 0 {
+				return errorReply("ERR syntax error")
+			}
+			count = n
+		default:
+			return errorReply("ERR syntax error")
+		}
+		i++
+	}
+
+	keys := array{}
+	next := "0"
+
+	b := bucket(tx, sess, false)
+	if b == nil {
+		return array{bulk(next), keys}
+	}
+
+	err := b.ScanPrefixRange(prefix, after, nil, func(key []byte, value []byte) bool {
+		if after != nil && bytes.Equal(key, after) {
+			return true
+		}
+
+		// one more key means the scan is not done
+		if len(keys) == count {
+			next = encodeCursor(keys[len(keys)-1].(bulk))
+			return false
+		}
+
+		keys = append(keys, bulk(append([]byte{}, key...)))
+		return true
+	})
+	if err != nil {
+		return errorReply("ERR " + err.Error())
+	}
+
+	return array{bulk(next), keys}
+}
+
+// encodeCursor returns the cursor resuming a scan after key. clients parse
+// cursors as numbers, so it is the key read as a big endian number after a
+// 1 byte, which keeps it apart from the cursor 0 starting a scan
+func encodeCursor(key []byte) string {
+	return new(big.Int).SetBytes(append([]byte{1}, key...)).String()
+}
+
+// decodeCursor returns the key a scan resumes after, nil for the cursor 0
+func decodeCursor(cursor string) ([]byte, bool) {
+	if cursor == "0" {
+		return nil, true
+	}
+
+	n, ok := new(big.Int).SetString(cursor, 10)
+	if !ok || n.Sign() <= 0 {
+		return nil, false
+	}
+
+	buf := n.Bytes()
+	if buf[0] != 1 {
+		return nil, false
+	}
+
+	return buf[1:], true
+}
+
+func scanExact(tx *kvdb.Tx, sess *session, key []byte) reply {
+	keys := array{}
+	if reply := exists(tx, sess, [][]byte{nil, key}); reply == integer(1) {
+		keys = append(keys, bulk(key))
+	}
+
+	return array{bulk("0"), keys}
+}
+
+// commandDocs answers the COMMAND calls clients make when they connect with
+// an empty list
+func commandDocs(tx *kvdb.Tx, sess *session, args [][]byte) reply {
+	return array{}
+}
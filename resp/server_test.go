@@ -0,0 +1,252 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"ahmedash95/kvdb"
+)
+
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startServer(t *testing.T) (*kvdb.DB, *client) {
+	db, err := kvdb.Open(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(db)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-served; err != ErrServerClosed {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	return db, dial(t, l.Addr().String())
+}
+
+// mustBucket returns a handle of the named bucket, creating it
+func mustBucket(t *testing.T, db *kvdb.DB, name string) *kvdb.Bucket {
+	t.Helper()
+
+	bucket, err := db.Bucket(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bucket
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply written like redis-cli does
+func (c *client) do(args ...string) string {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return c.read()
+}
+
+func (c *client) read() string {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+', '-', ':':
+		return line[1:]
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return fmt.Sprintf("%q", buf[:size])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+
+	c.t.Fatalf("unexpected reply %q", line)
+	return ""
+}
+
+func (c *client) expect(expected string, args ...string) {
+	c.t.Helper()
+
+	if got := c.do(args...); got != expected {
+		c.t.Fatalf("%s: expected %s but got %s", strings.Join(args, " "), expected, got)
+	}
+}
+
+func TestServer(t *testing.T) {
+	db, c := startServer(t)
+
+	c.expect("PONG", "PING")
+	c.expect(`"hello"`, "ECHO", "hello")
+	c.expect("(nil)", "GET", "user:1")
+	c.expect("OK", "SET", "user:1", "ahmed")
+	c.expect(`"ahmed"`, "GET", "user:1")
+	c.expect("(nil)", "SET", "user:1", "other", "NX")
+	c.expect("(nil)", "SET", "user:2", "other", "XX")
+	c.expect("OK", "SET", "user:2", "sara", "EX", "100")
+	c.expect("2", "EXISTS", "user:1", "user:2", "user:3")
+	c.expect("ERR wrong number of arguments for 'get' command", "GET")
+	c.expect("ERR unknown command 'FLUSHALL'", "FLUSHALL")
+	c.expect("ERR syntax error", "SET", "user:1", "a", "EX")
+
+	// buckets are selected by name
+	c.expect("OK", "SELECT", "orders")
+	c.expect("(nil)", "GET", "user:1")
+	c.expect("OK", "SET", "order:1", "book")
+	c.expect("OK", "SELECT", "0")
+	c.expect("1", "DEL", "user:1", "user:3")
+
+	value, err := mustBucket(t, db, "orders").Get([]byte("order:1"))
+	if err != nil || string(value) != "book" {
+		t.Fatalf("expected the order to be in the orders bucket but got %q %v", value, err)
+	}
+
+	// inline commands
+	if _, err := c.conn.Write([]byte("GET user:2\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.read(); got != `"sara"` {
+		t.Fatalf("expected sara but got %s", got)
+	}
+
+	c.expect("OK", "QUIT")
+}
+
+func TestServerScan(t *testing.T) {
+	_, c := startServer(t)
+
+	for i := 0; i < 25; i++ {
+		c.expect("OK", "SET", fmt.Sprintf("user:%02d", i), "x")
+	}
+	c.expect("OK", "SET", "order:1", "x")
+
+	var keys []string
+	cursor := "0"
+	for {
+		reply := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "10")
+
+		// [cursor [keys...]]
+		fields := strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(reply))
+		cursor = strings.Trim(fields[0], `"`)
+		keys = append(keys, fields[1:]...)
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if len(keys) != 25 || keys[0] != `"user:00"` || keys[24] != `"user:24"` {
+		t.Fatalf("expected the 25 user keys in order but got %v", keys)
+	}
+
+	// the scan resumes after the last key returned even once it is deleted
+	reply := c.do("SCAN", "0", "MATCH", "user:*", "COUNT", "2")
+	cursor = strings.Trim(strings.Fields(strings.NewReplacer("[", " ", "]", " ").Replace(reply))[0], `"`)
+	c.expect("1", "DEL", "user:01")
+	c.expect(fmt.Sprintf(`[%q ["user:02" "user:03"]]`, encodeCursor([]byte("user:03"))), "SCAN", cursor, "MATCH", "user:*", "COUNT", "2")
+	c.expect("ERR invalid cursor", "SCAN", "abc")
+
+	c.expect(`["0" ["order:1"]]`, "SCAN", "0", "MATCH", "order:1")
+	c.expect(`["0" []]`, "SCAN", "0", "MATCH", "missing")
+	c.expect("ERR only prefix patterns like user:* are supported", "SCAN", "0", "MATCH", "*:1")
+}
+
+func TestServerLimits(t *testing.T) {
+	_, c := startServer(t)
+
+	for _, cmd := range []string{
+		fmt.Sprintf("*%d\r\n", DefaultMaxArgs+1),
+		fmt.Sprintf("*1\r\n$%d\r\n", DefaultMaxBulkLen+1),
+	} {
+		c := dial(t, c.conn.RemoteAddr().String())
+		if _, err := c.conn.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.read(); got != "ERR Protocol error" {
+			t.Fatalf("expected %q to be a protocol error but got %s", cmd, got)
+		}
+	}
+}
+
+func TestServerMulti(t *testing.T) {
+	db, c := startServer(t)
+
+	c.expect("OK", "SET", "a", "1")
+
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "b", "2")
+	c.expect("QUEUED", "DEL", "a")
+	c.expect("QUEUED", "GET", "b")
+
+	// nothing is written before EXEC
+	if _, err := mustBucket(t, db, "0").Get([]byte("b")); err == nil {
+		t.Fatal("expected b to be written only by EXEC")
+	}
+
+	c.expect(`[OK 1 "2"]`, "EXEC")
+	c.expect("(nil)", "GET", "a")
+
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "c", "3")
+	c.expect("OK", "DISCARD")
+	c.expect("(nil)", "GET", "c")
+
+	// a command that cannot be queued aborts the transaction
+	c.expect("OK", "MULTI")
+	c.expect("QUEUED", "SET", "c", "3")
+	c.expect("ERR wrong number of arguments for 'get' command", "GET")
+	c.expect("EXECABORT Transaction discarded because of previous errors.", "EXEC")
+	c.expect("(nil)", "GET", "c")
+
+	c.expect("ERR EXEC without MULTI", "EXEC")
+}
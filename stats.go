@@ -0,0 +1,197 @@
+package kvdb
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the sizes and counters of the database
+type Stats struct {
+	FileSize  int64
+	PageN     int // pages in the file, the meta page included
+	FreePageN int // pages in the freelist, the pages holding it are not free
+	BucketN   int // buckets, the ones the database keeps for itself included
+
+	TxN       int64 // read-only transactions started
+	WriteTxN  int64 // writable transactions started
+	OpenTxN   int64 // transactions not committed or rolled back yet
+	CommitN   int64
+	RollbackN int64 // writable transactions rolled back
+
+	CacheHitN  int64 // nodes found in memory
+	CacheMissN int64 // nodes read from disk
+
+	// operations on user buckets, a deleted range counts every key it removed
+	GetN    int64
+	PutN    int64
+	DeleteN int64
+
+	SplitN     int64 // nodes split because they were full
+	PageAllocN int64 // pages taken for new nodes and the freelist, reused ones included
+	PageFreeN  int64 // pages given back to the freelist
+
+	CommitLatency Histogram // time Commit takes, fsync included
+	SyncLatency   Histogram // time an fsync takes, a commit syncs before and after the meta page
+}
+
+// latencyBounds are the upper bounds of the buckets of the latency histograms
+var latencyBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Histogram counts durations in buckets. Counts[i] is how many durations
+// were above Bounds[i-1] and at most Bounds[i], the last count is for the
+// durations above every bound
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+type histogram struct {
+	counts [len(latencyBounds) + 1]atomic.Int64
+	sum    atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	snapshot := Histogram{
+		Bounds: latencyBounds[:],
+		Counts: make([]int64, len(h.counts)),
+		Sum:    time.Duration(h.sum.Load()),
+	}
+
+	for i := range h.counts {
+		snapshot.Counts[i] = h.counts[i].Load()
+		snapshot.Count += snapshot.Counts[i]
+	}
+
+	return snapshot
+}
+
+// counters are updated as the database is used and reported by Stats
+type counters struct {
+	txN        atomic.Int64
+	writeTxN   atomic.Int64
+	openTxN    atomic.Int64
+	commitN    atomic.Int64
+	rollbackN  atomic.Int64
+	cacheHitN  atomic.Int64
+	cacheMissN atomic.Int64
+
+	getN    atomic.Int64
+	putN    atomic.Int64
+	deleteN atomic.Int64
+
+	splitN     atomic.Int64
+	pageAllocN atomic.Int64
+	pageFreeN  atomic.Int64
+
+	commitLatency histogram
+	syncLatency   histogram
+}
+
+// Stats returns the sizes and counters of the database. it waits for the
+// running writable transaction to finish
+func (db *DB) Stats() (Stats, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return Stats{
+		FileSize:   info.Size(),
+		PageN:      int(db.meta.pgid) + 1,
+		FreePageN:  len(db.meta.freelist),
+		BucketN:    len(db.meta.buckets),
+		TxN:        db.counters.txN.Load(),
+		WriteTxN:   db.counters.writeTxN.Load(),
+		OpenTxN:    db.counters.openTxN.Load(),
+		CommitN:    db.counters.commitN.Load(),
+		RollbackN:  db.counters.rollbackN.Load(),
+		CacheHitN:  db.counters.cacheHitN.Load(),
+		CacheMissN: db.counters.cacheMissN.Load(),
+
+		GetN:    db.counters.getN.Load(),
+		PutN:    db.counters.putN.Load(),
+		DeleteN: db.counters.deleteN.Load(),
+
+		SplitN:     db.counters.splitN.Load(),
+		PageAllocN: db.counters.pageAllocN.Load(),
+		PageFreeN:  db.counters.pageFreeN.Load(),
+
+		CommitLatency: db.counters.commitLatency.snapshot(),
+		SyncLatency:   db.counters.syncLatency.snapshot(),
+	}, nil
+}
+
+// BucketStats describe the shape of the tree of a bucket. values are stored
+// in the leaf holding their key, so there are no overflow pages
+type BucketStats struct {
+	KeyN          int // keys, the expired ones not swept yet included
+	Depth         int // levels of the tree, 1 when the root is a leaf
+	LeafPageN     int
+	InternalPageN int
+	LeafInuse     int     // bytes of the leaf pages holding data
+	InternalInuse int     // bytes of the internal pages holding data
+	Allocated     int     // bytes of every page of the tree
+	Fill          float64 // share of the allocated bytes holding data
+}
+
+// Stats walks the tree of the bucket and returns its shape
+func (b *Bucket) Stats() (BucketStats, error) {
+	var stats BucketStats
+	err := b.view(func(b *Bucket) error {
+		b.node(b.root).stats(&stats, 1)
+		return nil
+	})
+
+	if stats.Allocated > 0 {
+		stats.Fill = float64(stats.LeafInuse+stats.InternalInuse) / float64(stats.Allocated)
+	}
+
+	return stats, err
+}
+
+func (n *Node) stats(stats *BucketStats, depth int) {
+	if depth > stats.Depth {
+		stats.Depth = depth
+	}
+
+	stats.Allocated += PAGE_SIZE
+
+	if n.typ == NODE_TYPE_LEAF {
+		stats.KeyN += len(n.Keys)
+		stats.LeafPageN++
+		stats.LeafInuse += n.size()
+		return
+	}
+
+	stats.InternalPageN++
+	stats.InternalInuse += n.size()
+
+	for _, child := range n.children {
+		n.child(child).stats(stats, depth+1)
+	}
+}
@@ -0,0 +1,107 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDBStats(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "numbers")
+	for i := 0; i < 100; i++ {
+		err = bucket.Put([]byte(fmt.Sprintf("%03d", i)), []byte(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bucket.DeleteRange([]byte("020"), []byte("060")); err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	db.Update(func(tx *Tx) error { return errAbort })
+
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.PageN != int(db.meta.pgid)+1 || stats.FreePageN != len(db.meta.freelist) || stats.FreePageN == 0 {
+		t.Fatalf("unexpected page counts %+v", stats)
+	}
+	if stats.FileSize != pageOffset(uint64(stats.PageN-1))+PAGE_SIZE {
+		t.Fatalf("expected file size %d but got %d", pageOffset(uint64(stats.PageN-1))+PAGE_SIZE, stats.FileSize)
+	}
+	if stats.BucketN != 1 || stats.CommitN != 102 || stats.RollbackN != 1 || stats.WriteTxN != 103 || stats.OpenTxN != 0 {
+		t.Fatalf("unexpected transaction counts %+v", stats)
+	}
+	if stats.PutN != 100 || stats.DeleteN != 40 || stats.GetN != 0 || stats.SplitN == 0 {
+		t.Fatalf("unexpected operation counts %+v", stats)
+	}
+	// every page is used by a node, free or holds the freelist
+	used := stats.PageAllocN - stats.PageFreeN
+	if used != int64(stats.PageN-1-stats.FreePageN) {
+		t.Fatalf("unexpected page counts %+v", stats)
+	}
+	if stats.CommitLatency.Count != 102 || stats.SyncLatency.Count != 204 || stats.CommitLatency.Sum < stats.SyncLatency.Sum {
+		t.Fatalf("unexpected latencies %+v %+v", stats.CommitLatency, stats.SyncLatency)
+	}
+	if len(stats.CommitLatency.Counts) != len(stats.CommitLatency.Bounds)+1 {
+		t.Fatalf("expected a count for every bucket of the histogram but got %+v", stats.CommitLatency)
+	}
+
+	// every node was created in memory
+	if stats.CacheHitN == 0 || stats.CacheMissN != 0 {
+		t.Fatalf("expected only cache hits but got %+v", stats)
+	}
+
+	bucketStats, err := bucket.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bucketStats.KeyN != 60 {
+		t.Fatalf("expected 60 keys but got %d", bucketStats.KeyN)
+	}
+	if bucketStats.Depth < 3 || bucketStats.LeafPageN < 60/3 || bucketStats.InternalPageN == 0 {
+		t.Fatalf("unexpected tree shape %+v", bucketStats)
+	}
+	pages := bucketStats.LeafPageN + bucketStats.InternalPageN
+	if pages+stats.FreePageN+len(db.meta.chain) != stats.PageN-1 || bucketStats.Allocated != pages*PAGE_SIZE {
+		t.Fatalf("expected the tree and the freelist to hold every page but got %+v", bucketStats)
+	}
+	if bucketStats.Fill <= 0 || bucketStats.Fill >= 1 {
+		t.Fatalf("unexpected fill %f", bucketStats.Fill)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh database reads every node from disk once
+	db, err = Open(path, &Config{maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if _, err := mustBucket(t, db, "numbers").Stats(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.CacheMissN != int64(pages) {
+		t.Fatalf("expected %d cache misses but got %d", pages, stats.CacheMissN)
+	}
+}
@@ -0,0 +1,218 @@
+package kvdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// every bucket with keys written by PutWithTTL has two internal buckets
+//
+//	ttl bucket:    key -> expiry
+//	expiry bucket: expiry + key -> nothing
+//
+// the first one answers whether a key expired, the second one keeps keys in
+// the order they expire so the sweeper only visits expired ones. expiry is
+// the unix time in nanoseconds, 8 bytes big endian so it sorts in time order
+
+func ttlBucketName(name string) string {
+	return internalBucketPrefix + "ttl:" + name
+}
+
+func expiryBucketName(name string) string {
+	return internalBucketPrefix + "exp:" + name
+}
+
+func encodeExpiry(t time.Time) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+	return buf
+}
+
+// PutWithTTL writes value under key like Put, and makes the key expire
+// after ttl. expired keys are not returned by Get or Scan and are removed
+// by a background sweeper
+func (b *Bucket) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive")
+	}
+
+	if err := b.checkSize(key, value); err != nil {
+		return err
+	}
+
+	return b.update(func(b *Bucket) error {
+		b.forget(key)
+		b.put(key, value)
+
+		expiry := encodeExpiry(b.db.now().Add(ttl))
+		b.tx.Bucket(ttlBucketName(b.name)).put(key, expiry)
+		b.tx.Bucket(expiryBucketName(b.name)).put(append(expiry, key...), nil)
+
+		return nil
+	})
+}
+
+// expired reports whether key has an expiry that passed
+func (b *Bucket) expired(key []byte) bool {
+	ttl := b.tx.bucket(ttlBucketName(b.name), false)
+	if ttl == nil {
+		return false
+	}
+
+	expiry, ok := ttl.lookup(key)
+	if !ok {
+		return false
+	}
+
+	return binary.BigEndian.Uint64(expiry) <= uint64(b.db.now().UnixNano())
+}
+
+// forget drops the expiry of key if it has one
+func (b *Bucket) forget(key []byte) {
+	ttl := b.tx.bucket(ttlBucketName(b.name), false)
+	if ttl == nil {
+		return
+	}
+
+	expiry, ok := ttl.lookup(key)
+	if !ok {
+		return
+	}
+
+	ttl.delete(key)
+	b.tx.Bucket(expiryBucketName(b.name)).delete(append(append([]byte{}, expiry...), key...))
+}
+
+// forgetRange drops the expiry of every key in [start, end)
+func (b *Bucket) forgetRange(start []byte, end []byte) {
+	ttl := b.tx.bucket(ttlBucketName(b.name), false)
+	if ttl == nil {
+		return
+	}
+
+	// the ttl bucket is in byte order, the range is in the order of the
+	// comparator of the bucket
+	if b.comparator.Compare != nil {
+		var keys [][]byte
+		b.node(b.root).scanRange(start, end, func(key []byte, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+
+		for _, key := range keys {
+			b.forget(key)
+		}
+		return
+	}
+
+	expiries := b.tx.Bucket(expiryBucketName(b.name))
+	ttl.node(ttl.root).scanRange(start, end, func(key []byte, expiry []byte) bool {
+		expiries.delete(append(append([]byte{}, expiry...), key...))
+		return true
+	})
+
+	ttl.deleteRange(start, end)
+}
+
+// sweep removes up to limit expired keys from every bucket, each bucket in
+// a transaction of its own. it returns how many keys were removed
+func (db *DB) sweep(limit int) (int, error) {
+	// find the buckets with expired keys in a read-only transaction, so
+	// nothing is committed when no key expired
+	var names []string
+	err := db.View(func(tx *Tx) (err error) {
+		defer recoverReadError(&err)
+
+		end := encodeExpiry(db.now().Add(time.Nanosecond))
+		for _, record := range db.meta.buckets {
+			if isInternalBucket(record.name) {
+				continue
+			}
+
+			expiries := tx.bucket(expiryBucketName(record.name), false)
+			if expiries == nil {
+				continue
+			}
+
+			expired := false
+			expiries.node(expiries.root).scanRange(nil, end, func(key []byte, value []byte) bool {
+				expired = true
+				return false
+			})
+			if expired {
+				names = append(names, record.name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, name := range names {
+		err := db.Update(func(tx *Tx) (err error) {
+			defer recoverReadError(&err)
+
+			b := tx.Bucket(name)
+			expiries := tx.Bucket(expiryBucketName(name))
+			end := encodeExpiry(db.now().Add(time.Nanosecond))
+
+			var expired [][]byte
+			expiries.node(expiries.root).scanRange(nil, end, func(key []byte, value []byte) bool {
+				expired = append(expired, key)
+				return len(expired) < limit
+			})
+
+			for _, key := range expired {
+				b.forget(key[8:])
+				b.delete(key[8:])
+			}
+
+			total += len(expired)
+
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// sweeper removes expired keys every Config.TTLSweepInterval until the
+// database is closed. it removes them in batches of Config.TTLSweepBatch
+// keys so writers are not blocked for long
+func (db *DB) sweeper() {
+	defer db.sweeperWg.Done()
+
+	ticker := time.NewTicker(db.config.TTLSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.closing:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			n, err := db.sweep(db.config.TTLSweepBatch)
+			if err != nil && db.config.OnSweepError != nil {
+				db.config.OnSweepError(err)
+			}
+			// a full batch means there may be more expired keys
+			if err != nil || n < db.config.TTLSweepBatch {
+				break
+			}
+
+			select {
+			case <-db.closing:
+				return
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock the tests move forward by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestBucketPutWithTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	db, err := Open(tempDBPath(t), &Config{now: clock.Now, TTLSweepInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "sessions")
+
+	if err := bucket.PutWithTTL([]byte("short"), []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.PutWithTTL([]byte("long"), []byte("2"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.PutWithTTL([]byte("persisted"), []byte("3"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// a plain Put drops the expiry
+	if err := bucket.Put([]byte("persisted"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(2 * time.Minute)
+
+	if _, err := bucket.Get([]byte("short")); err == nil {
+		t.Fatal("expected expired key to be not found")
+	}
+
+	keys := []string{}
+	bucket.Scan(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	if fmt.Sprint(keys) != "[long persisted]" {
+		t.Fatalf("expected keys [long persisted] but got %v", keys)
+	}
+
+	// an expired key counts as absent
+	ok, err := bucket.PutIfAbsent([]byte("short"), []byte("4"))
+	if err != nil || !ok {
+		t.Fatalf("expected PutIfAbsent on an expired key to write but got %v %v", ok, err)
+	}
+
+	clock.Add(2 * time.Hour)
+
+	if _, err := bucket.Get([]byte("long")); err == nil {
+		t.Fatal("expected expired key to be not found")
+	}
+
+	for _, key := range []string{"short", "persisted"} {
+		if _, err := bucket.Get([]byte(key)); err != nil {
+			t.Fatalf("expected %s to be kept but got %v", key, err)
+		}
+	}
+}
+
+func TestDBSweepExpiredKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	db, err := Open(tempDBPath(t), &Config{now: clock.Now, TTLSweepInterval: -1, maxKeysPerNode: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "sessions")
+	for i := 0; i < 50; i++ {
+		ttl := time.Minute
+		if i%2 == 0 {
+			ttl = time.Hour
+		}
+
+		err := bucket.PutWithTTL([]byte(fmt.Sprintf("session%02d", i)), []byte("x"), ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock.Add(2 * time.Minute)
+
+	// the sweeper removes expired keys in bounded batches
+	n, err := db.sweep(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Fatalf("expected a batch of 10 keys but got %d", n)
+	}
+
+	for n == 10 {
+		if n, err = db.sweep(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := 0
+	err = db.View(func(tx *Tx) error {
+		tx.Bucket("sessions").node(tx.Bucket("sessions").root).scan(func(key, value []byte) bool {
+			count++
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 25 {
+		t.Fatalf("expected 25 keys left in the tree but got %d", count)
+	}
+
+	// a sweep that finds nothing expired commits nothing
+	txid := db.meta.txid
+	if n, err := db.sweep(10); err != nil || n != 0 {
+		t.Fatalf("expected nothing to sweep but got %d %v", n, err)
+	}
+	if db.meta.txid != txid {
+		t.Fatalf("expected no commit but the txid moved from %d to %d", txid, db.meta.txid)
+	}
+}
+
+func TestDBSweeperRunsInBackground(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{TTLSweepInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "sessions")
+	if err := bucket.PutWithTTL([]byte("session"), []byte("x"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var found bool
+		err := db.View(func(tx *Tx) error {
+			_, found = tx.Bucket("sessions").lookup([]byte("session"))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !found {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected the sweeper to remove the expired key")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDBSweeperReportsErrors(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, &Config{TTLSweepInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mustBucket(t, db, "sessions").PutWithTTL([]byte("session"), []byte("x"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	root := db.meta.record("sessions").rootpage
+	db.Close()
+
+	flipByte(t, path, root, PAGE_SIZE-1)
+	time.Sleep(2 * time.Millisecond)
+
+	errs := make(chan error, 1)
+	db, err = Open(path, &Config{
+		TTLSweepInterval: 10 * time.Millisecond,
+		OnSweepError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	select {
+	case err := <-errs:
+		var mismatch ErrChecksumMismatch
+		if !errors.As(err, &mismatch) || mismatch.PageID != root {
+			t.Fatalf("expected a checksum mismatch of page %d but got %v", root, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the sweeper to report the page it cannot read")
+	}
+}
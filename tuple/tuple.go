@@ -0,0 +1,335 @@
+// Package tuple encodes tuples of values into keys whose byte order, the
+// order of the B+tree, is the order of the tuples. tuples are compared value
+// by value, a tuple sorts before the longer tuples it is a prefix of.
+//
+// the encoding is the one of the FoundationDB tuple layer. every value starts
+// with a type code, values of different types are ordered by it
+//
+//	nil                      0x00
+//	[]byte                   0x01, bytes with 0x00 escaped as 0x00 0xff, 0x00
+//	string                   0x02, UTF-8 escaped like []byte, 0x00
+//	Tuple                    0x05, values with nil as 0x00 0xff, 0x00
+//	integers                 0x0c to 0x1c, see below
+//	float32                  0x20, 4 bytes
+//	float64                  0x21, 8 bytes
+//	false, true              0x26, 0x27
+//
+// integers take as few big endian bytes as they need. zero is 0x14, a
+// positive integer of n bytes is 0x14+n followed by them and a negative one
+// 0x14-n followed by the one's complement of its absolute value. floats are
+// stored big endian with the sign bit flipped, every bit flipped for
+// negative numbers, so they sort in numeric order
+package tuple
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	nilCode     = 0x00
+	bytesCode   = 0x01
+	stringCode  = 0x02
+	nestedCode  = 0x05
+	intZeroCode = 0x14
+	float32Code = 0x20
+	float64Code = 0x21
+	falseCode   = 0x26
+	trueCode    = 0x27
+)
+
+// Tuple is a list of values of the types nil, []byte, string, Tuple, every
+// signed and unsigned integer type, float32, float64 and bool
+type Tuple []any
+
+// Pack encodes the tuple. it panics if a value has a type that is not
+// supported, which is a bug of the caller
+func (t Tuple) Pack() []byte {
+	return t.pack(nil, false)
+}
+
+func (t Tuple) pack(buf []byte, nested bool) []byte {
+	for _, v := range t {
+		switch v := v.(type) {
+		case nil:
+			buf = append(buf, nilCode)
+			if nested {
+				buf = append(buf, 0xff)
+			}
+		case []byte:
+			buf = appendEscaped(append(buf, bytesCode), v)
+		case string:
+			buf = appendEscaped(append(buf, stringCode), []byte(v))
+		case Tuple:
+			buf = append(v.pack(append(buf, nestedCode), true), 0x00)
+		case int:
+			buf = appendInt(buf, int64(v))
+		case int8:
+			buf = appendInt(buf, int64(v))
+		case int16:
+			buf = appendInt(buf, int64(v))
+		case int32:
+			buf = appendInt(buf, int64(v))
+		case int64:
+			buf = appendInt(buf, v)
+		case uint:
+			buf = appendUint(buf, uint64(v))
+		case uint8:
+			buf = appendUint(buf, uint64(v))
+		case uint16:
+			buf = appendUint(buf, uint64(v))
+		case uint32:
+			buf = appendUint(buf, uint64(v))
+		case uint64:
+			buf = appendUint(buf, v)
+		case float32:
+			buf = binary.BigEndian.AppendUint32(append(buf, float32Code), orderFloat32(math.Float32bits(v)))
+		case float64:
+			buf = binary.BigEndian.AppendUint64(append(buf, float64Code), orderFloat64(math.Float64bits(v)))
+		case bool:
+			if v {
+				buf = append(buf, trueCode)
+			} else {
+				buf = append(buf, falseCode)
+			}
+		default:
+			panic(fmt.Sprintf("tuple: unsupported type %T", v))
+		}
+	}
+
+	return buf
+}
+
+func appendEscaped(buf []byte, b []byte) []byte {
+	for _, c := range b {
+		buf = append(buf, c)
+		if c == 0x00 {
+			buf = append(buf, 0xff)
+		}
+	}
+
+	return append(buf, 0x00)
+}
+
+// byteLen returns how many bytes n needs
+func byteLen(n uint64) int {
+	size := 0
+	for n > 0 {
+		size++
+		n >>= 8
+	}
+	return size
+}
+
+func appendUint(buf []byte, n uint64) []byte {
+	size := byteLen(n)
+	buf = append(buf, byte(intZeroCode+size))
+
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(n>>(8*i)))
+	}
+	return buf
+}
+
+func appendInt(buf []byte, n int64) []byte {
+	if n >= 0 {
+		return appendUint(buf, uint64(n))
+	}
+
+	// the one's complement of the absolute value, in as many bytes as it
+	// needs, so larger absolute values sort first
+	size := byteLen(uint64(-n))
+	mask := ^uint64(0) >> (64 - 8*size)
+	v := uint64(n) + mask
+
+	buf = append(buf, byte(intZeroCode-size))
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(v>>(8*i)))
+	}
+	return buf
+}
+
+// orderFloat64 flips the sign bit of positive numbers and every bit of
+// negative ones, so the bits compare like the numbers
+func orderFloat64(bits uint64) uint64 {
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+func orderFloat32(bits uint32) uint32 {
+	if bits&(1<<31) != 0 {
+		return ^bits
+	}
+	return bits | 1<<31
+}
+
+// Unpack decodes a tuple encoded by Pack. integers are decoded as int64, or
+// as uint64 when they do not fit in an int64
+func Unpack(data []byte) (Tuple, error) {
+	t, _, err := unpack(data, false)
+	return t, err
+}
+
+// unpack decodes values until data ends or, for a nested tuple, until its
+// terminator. it returns what is left after the terminator
+func unpack(data []byte, nested bool) (Tuple, []byte, error) {
+	t := Tuple{}
+	for len(data) > 0 {
+		code := data[0]
+		data = data[1:]
+
+		switch {
+		case code == nilCode:
+			if !nested {
+				t = append(t, nil)
+				continue
+			}
+
+			// nil is escaped inside nested tuples, a lone 0x00 ends them
+			if len(data) > 0 && data[0] == 0xff {
+				t = append(t, nil)
+				data = data[1:]
+				continue
+			}
+			return t, data, nil
+		case code == bytesCode || code == stringCode:
+			b, rest, err := readEscaped(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			data = rest
+
+			if code == bytesCode {
+				t = append(t, b)
+			} else {
+				t = append(t, string(b))
+			}
+		case code == nestedCode:
+			inner, rest, err := unpack(data, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			t = append(t, inner)
+			data = rest
+		case code >= intZeroCode-8 && code <= intZeroCode+8:
+			v, rest, err := readInt(code, data)
+			if err != nil {
+				return nil, nil, err
+			}
+			t = append(t, v)
+			data = rest
+		case code == float32Code:
+			if len(data) < 4 {
+				return nil, nil, fmt.Errorf("tuple: truncated float32")
+			}
+			bits := binary.BigEndian.Uint32(data)
+			if bits&(1<<31) != 0 {
+				bits ^= 1 << 31
+			} else {
+				bits = ^bits
+			}
+			t = append(t, math.Float32frombits(bits))
+			data = data[4:]
+		case code == float64Code:
+			if len(data) < 8 {
+				return nil, nil, fmt.Errorf("tuple: truncated float64")
+			}
+			bits := binary.BigEndian.Uint64(data)
+			if bits&(1<<63) != 0 {
+				bits ^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			t = append(t, math.Float64frombits(bits))
+			data = data[8:]
+		case code == falseCode:
+			t = append(t, false)
+		case code == trueCode:
+			t = append(t, true)
+		default:
+			return nil, nil, fmt.Errorf("tuple: unknown type code 0x%02x", code)
+		}
+	}
+
+	if nested {
+		return nil, nil, fmt.Errorf("tuple: nested tuple is not terminated")
+	}
+
+	return t, nil, nil
+}
+
+func readEscaped(data []byte) ([]byte, []byte, error) {
+	b := []byte{}
+	for i := 0; i < len(data); i++ {
+		if data[i] != 0x00 {
+			b = append(b, data[i])
+			continue
+		}
+
+		if i+1 < len(data) && data[i+1] == 0xff {
+			b = append(b, 0x00)
+			i++
+			continue
+		}
+
+		return b, data[i+1:], nil
+	}
+
+	return nil, nil, fmt.Errorf("tuple: bytes are not terminated")
+}
+
+func readInt(code byte, data []byte) (any, []byte, error) {
+	size := int(code) - intZeroCode
+	if size < 0 {
+		size = -size
+	}
+	if len(data) < size {
+		return nil, nil, fmt.Errorf("tuple: truncated integer")
+	}
+
+	var v uint64
+	for _, c := range data[:size] {
+		v = v<<8 | uint64(c)
+	}
+	data = data[size:]
+
+	if code >= intZeroCode {
+		if v > math.MaxInt64 {
+			return v, data, nil
+		}
+		return int64(v), data, nil
+	}
+
+	mask := ^uint64(0) >> (64 - 8*size)
+	return -int64(mask - v), data, nil
+}
+
+// Range returns the range of keys, for Bucket.ScanRange, holding the tuple
+// and every tuple it is a prefix of
+func (t Tuple) Range() (start []byte, end []byte) {
+	start = t.Pack()
+
+	// every value starts with a type code lower than 0xff
+	return start, append(append([]byte{}, start...), 0xff)
+}
+
+// Codec encodes tuples for the keys of a kvdb.TypedBucket
+type Codec struct{}
+
+func (Codec) Encode(t Tuple) (data []byte, err error) {
+	// report unsupported types as errors, the caller may not control them
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return t.Pack(), nil
+}
+
+func (Codec) Decode(data []byte) (Tuple, error) {
+	return Unpack(data)
+}
@@ -0,0 +1,163 @@
+package tuple
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"ahmedash95/kvdb"
+)
+
+// tuples in the order their keys must sort
+var ordered = []Tuple{
+	{},
+	{nil},
+	{nil, "a"},
+	{[]byte{}},
+	{[]byte{0x00}},
+	{[]byte{0x00, 0x00}},
+	{[]byte{0x01}},
+	{""},
+	{"a"},
+	{"a", nil},
+	{"a", int64(-1)},
+	{"a", int64(1)},
+	{"a\x00"},
+	{"ab"},
+	{Tuple{}},
+	{Tuple{nil}},
+	{Tuple{nil, nil}},
+	{Tuple{"a"}},
+	{Tuple{"a"}, "b"},
+	{Tuple{"a", nil}},
+	{int64(math.MinInt64)},
+	{int64(-1 << 32)},
+	{int64(-256)},
+	{int64(-255)},
+	{int64(-1)},
+	{int64(0)},
+	{int64(1)},
+	{int64(255)},
+	{int64(256)},
+	{int64(math.MaxInt64)},
+	{uint64(math.MaxUint64)},
+	{float32(math.Inf(-1))},
+	{float32(-1.5)},
+	{float32(0)},
+	{float32(2.5)},
+	{math.Inf(-1)},
+	{-1e10},
+	{-0.5},
+	{0.0},
+	{0.5},
+	{1e10},
+	{math.Inf(1)},
+	{false},
+	{true},
+}
+
+func TestPackKeepsOrder(t *testing.T) {
+	for i, tuple := range ordered {
+		key := tuple.Pack()
+
+		unpacked, err := Unpack(key)
+		if err != nil {
+			t.Fatalf("%v: %v", tuple, err)
+		}
+		if !reflect.DeepEqual(unpacked, tuple) {
+			t.Fatalf("expected %#v to unpack to itself but got %#v", tuple, unpacked)
+		}
+
+		if i > 0 {
+			if prev := ordered[i-1].Pack(); bytes.Compare(prev, key) >= 0 {
+				t.Fatalf("expected %v (%x) to sort before %v (%x)", ordered[i-1], prev, tuple, key)
+			}
+		}
+	}
+}
+
+func TestPackIntegerTypes(t *testing.T) {
+	for _, v := range []any{int(-5), int8(-5), int16(-5), int32(-5), int64(-5)} {
+		if !bytes.Equal(Tuple{v}.Pack(), Tuple{int64(-5)}.Pack()) {
+			t.Fatalf("expected %T to pack like int64", v)
+		}
+	}
+	for _, v := range []any{uint(5), uint8(5), uint16(5), uint32(5), uint64(5), int64(5)} {
+		if !bytes.Equal(Tuple{v}.Pack(), Tuple{int(5)}.Pack()) {
+			t.Fatalf("expected %T to pack like int", v)
+		}
+	}
+}
+
+func TestUnpackInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		{0x02, 'a'},        // string without terminator
+		{0x05, 0x02, 0x00}, // nested tuple without terminator
+		{0x16, 0x01},       // integer shorter than its size
+		{0x21, 0x00},       // truncated float64
+		{0xff},             // unknown type code
+	} {
+		if _, err := Unpack(data); err == nil {
+			t.Fatalf("expected %x to be rejected", data)
+		}
+	}
+
+	if _, err := (Codec{}).Encode(Tuple{struct{}{}}); err == nil {
+		t.Fatal("expected an unsupported type to be rejected")
+	}
+}
+
+func TestRange(t *testing.T) {
+	db, err := kvdb.Open(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket, err := db.Bucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders := kvdb.NewTypedBucket[Tuple, string](bucket, Codec{}, kvdb.StringKey{})
+	for _, key := range []Tuple{
+		{"user", -1, "order"},
+		{"user", 2, "order", 1},
+		{"user", 2, "order", 2},
+		{"user", 2},
+		{"user", 10, "order", 1},
+		{"users", 2},
+	} {
+		if err := orders.Put(key, fmt.Sprint(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var keys []string
+	start, end := Tuple{"user", 2}.Range()
+	orders.Bucket().ScanRange(start, end, func(key []byte, value []byte) bool {
+		keys = append(keys, string(value))
+		return true
+	})
+
+	if fmt.Sprint(keys) != "[[user 2] [user 2 order 1] [user 2 order 2]]" {
+		t.Fatalf("expected the tuples starting with user 2 but got %v", keys)
+	}
+
+	keys = nil
+	err = orders.Scan(func(key Tuple, value string) bool {
+		keys = append(keys, fmt.Sprint(key))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(keys) != "[[user -1 order] [user 2] [user 2 order 1] [user 2 order 2] [user 10 order 1] [users 2]]" {
+		t.Fatalf("expected the tuples in order but got %v", keys)
+	}
+}
@@ -0,0 +1,318 @@
+package kvdb
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrTxClosed      = errors.New("tx closed")
+	ErrTxNotWritable = errors.New("tx not writable")
+)
+
+// Tx is a read-only or writable transaction. there is at most one writable
+// transaction at a time and it runs alone, read-only transactions run
+// concurrently with each other
+type Tx struct {
+	db       *DB
+	id       uint64
+	writable bool
+	done     bool
+	buckets  map[string]*Bucket // handles opened in the transaction
+
+	recording bool    // changes are recorded for watchers and the change log
+	changes   []Event // changes made by the transaction, logged and sent to watchers on commit
+
+	indexes map[*bucket]map[string]IndexFunc // indexes of the buckets before CreateIndex, restored on rollback
+
+	// meta state when the transaction started, restored on rollback
+	pgid         uint64
+	records      []MetaRecord
+	freelist     []uint64
+	freelistPage uint64
+	chain        []uint64
+}
+
+// Begin starts a transaction. it must be closed with Commit or Rollback
+func (db *DB) Begin(writable bool) (*Tx, error) {
+	if writable {
+		db.rwlock.Lock()
+	} else {
+		db.rwlock.RLock()
+	}
+
+	if writable {
+		db.counters.writeTxN.Add(1)
+	} else {
+		db.counters.txN.Add(1)
+	}
+	db.counters.openTxN.Add(1)
+
+	tx := &Tx{
+		db:       db,
+		id:       db.meta.txid,
+		writable: writable,
+		buckets:  make(map[string]*Bucket),
+	}
+
+	if writable {
+		tx.id++
+		tx.recording = db.config.ChangeLog || db.watching()
+		tx.pgid = db.meta.pgid
+		tx.freelist = append([]uint64{}, db.meta.freelist...)
+		tx.freelistPage = db.meta.freelistPage
+		tx.chain = db.meta.chain
+		for _, record := range db.meta.buckets {
+			tx.records = append(tx.records, *record)
+		}
+	}
+
+	return tx, nil
+}
+
+// ID returns the id of the transaction. ids grow by one with every commit,
+// a writable transaction gets the id after the last committed one and a
+// read-only transaction the id of the last committed one
+func (tx *Tx) ID() uint64 {
+	return tx.id
+}
+
+// Update runs fn in a writable transaction, committing it if fn returns nil
+// and rolling it back otherwise
+func (db *DB) Update(fn func(*Tx) error) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+
+	// make sure the transaction rolls back if fn panics
+	defer func() {
+		if !tx.done {
+			tx.Rollback()
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// View runs fn in a read-only transaction
+func (db *DB) View(fn func(*Tx) error) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	return fn(tx)
+}
+
+// Bucket returns a handle of the named bucket bound to the transaction.
+// writable transactions create the bucket if it does not exist, read-only
+// ones return nil
+func (tx *Tx) Bucket(name string) *Bucket {
+	return tx.bucket(name, tx.writable)
+}
+
+// Buckets returns the names of the buckets in the order they were created,
+// leaving out the buckets the database keeps for itself
+func (tx *Tx) Buckets() []string {
+	names := []string{}
+	for _, record := range tx.db.meta.buckets {
+		if !isInternalBucket(record.name) {
+			names = append(names, record.name)
+		}
+	}
+
+	return names
+}
+
+// bucket returns a handle of the named bucket, creating the bucket only when
+// create is true. it returns nil if the bucket does not exist
+func (tx *Tx) bucket(name string, create bool) *Bucket {
+	if b, ok := tx.buckets[name]; ok {
+		return b
+	}
+
+	shared := tx.db.bucket(name, create)
+	if shared == nil {
+		return nil
+	}
+
+	b := &Bucket{bucket: shared, tx: tx}
+	tx.buckets[name] = b
+
+	return b
+}
+
+// Commit writes the nodes changed by the transaction to new pages, then the
+// freelist and the meta page, which points to them, and syncs the file. the
+// pages the transaction replaced are reused only after the meta page is
+// written
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	start := time.Now()
+
+	if tx.db.config.ChangeLog {
+		if err := tx.logChanges(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(tx.buckets))
+	for name := range tx.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// nodes are written to pages the file does not use, so a commit that
+	// stops half way leaves the last one intact
+	var dirtyPages []uint64
+	for _, name := range names {
+		b := tx.buckets[name]
+		b.spill()
+		tx.db.meta.record(name).rootpage = b.root
+
+		for _, node := range b.nodes {
+			if !node.dirty {
+				continue
+			}
+
+			if err := tx.db.writeNode(node); err != nil {
+				tx.Rollback()
+				return err
+			}
+			dirtyPages = append(dirtyPages, node.pgid)
+		}
+	}
+	sort.Slice(dirtyPages, func(i, j int) bool { return dirtyPages[i] < dirtyPages[j] })
+
+	free, err := tx.db.writeFreelist()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// the meta page is the commit point, everything it points to must be
+	// on disk before it is written
+	if err := tx.db.sync(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tx.db.meta.txid = tx.id
+	if err := tx.db.writeMeta(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.db.sync(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// the pages replaced by the transaction are not used by the file anymore
+	tx.db.meta.release(free)
+
+	for _, b := range tx.buckets {
+		for _, node := range b.nodes {
+			node.dirty = false
+		}
+	}
+
+	tx.db.counters.commitN.Add(1)
+	tx.db.counters.commitLatency.observe(time.Since(start))
+	tx.db.notify(tx.changes)
+	tx.close()
+
+	tx.db.config.Hooks.OnCommit(tx.id, dirtyPages)
+
+	return nil
+}
+
+// Rollback discards every change made by the transaction
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+
+	if tx.writable {
+		tx.rollback()
+		tx.db.counters.rollbackN.Add(1)
+	}
+
+	tx.close()
+
+	if tx.writable {
+		tx.db.config.Hooks.OnRollback(tx.id)
+	}
+
+	return nil
+}
+
+// rollback restores the meta state the transaction started with and drops
+// the in-memory nodes of the buckets it touched so they are loaded again
+// from disk
+func (tx *Tx) rollback() {
+	db := tx.db
+
+	db.meta.pgid = tx.pgid
+	db.meta.txid = tx.id - 1
+	db.meta.freelist = tx.freelist
+	db.meta.freelistPage = tx.freelistPage
+	db.meta.chain = tx.chain
+	db.meta.pending = nil
+	db.meta.allocated = nil
+	db.meta.buckets = make([]*MetaRecord, 0, len(tx.records))
+	for i := range tx.records {
+		record := tx.records[i]
+		db.meta.buckets = append(db.meta.buckets, &record)
+	}
+
+	for b, indexes := range tx.indexes {
+		b.mu.Lock()
+		b.indexes = indexes
+		b.mu.Unlock()
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for name := range tx.buckets {
+		record := db.meta.record(name)
+		if record == nil {
+			// the bucket was created by the transaction
+			delete(db.buckets, name)
+			continue
+		}
+
+		b := db.buckets[name]
+		b.root = record.rootpage
+		b.nodes = make(map[uint64]*Node)
+	}
+}
+
+func (tx *Tx) close() {
+	tx.done = true
+	tx.db.counters.openTxN.Add(-1)
+
+	if tx.writable {
+		tx.db.rwlock.Unlock()
+	} else {
+		tx.db.rwlock.RUnlock()
+	}
+}
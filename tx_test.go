@@ -0,0 +1,308 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestDBReopen(t *testing.T) {
+	path := tempDBPath(t)
+
+	db, err := Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "user_emails")
+	names := []string{"Ibrahim", "Gamal", "Hassan", "Camal", "Basem", "Dawood", "Emad", "Ahmed", "Fady"}
+	for _, name := range names {
+		err = bucket.Put([]byte(name), []byte(fmt.Sprintf("%s@email.com", name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket = mustBucket(t, db, "user_emails")
+	for _, name := range names {
+		value, err := bucket.Get([]byte(name))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if string(value) != fmt.Sprintf("%s@email.com", name) {
+			t.Fatalf("expected email %s@email.com but got %s", name, value)
+		}
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	err = mustBucket(t, db, "user_emails").Put([]byte("Ahmed"), []byte("ahmed@email.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx *Tx) error {
+		bucket := tx.Bucket("user_emails")
+		for _, name := range []string{"Basem", "Camal", "Dawood", "Emad"} {
+			if err := bucket.Put([]byte(name), []byte(name)); err != nil {
+				return err
+			}
+		}
+
+		if err := bucket.Delete([]byte("Ahmed")); err != nil {
+			return err
+		}
+
+		tx.Bucket("countries").Put([]byte("Egypt"), []byte("Cairo"))
+
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("expected abort error but got %v", err)
+	}
+
+	keys := []string{}
+	mustBucket(t, db, "user_emails").Scan(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	if len(keys) != 1 || keys[0] != "Ahmed" {
+		t.Fatalf("expected only Ahmed after rollback but got %v", keys)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if tx.Bucket("countries") != nil {
+			t.Fatal("expected bucket created in the rolled back tx to be gone")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxCommitInterrupted(t *testing.T) {
+	path := tempDBPath(t)
+
+	db, err := Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "numbers")
+	for i := 0; i < 20; i++ {
+		if err := bucket.Put([]byte(fmt.Sprintf("%02d", i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tx.Bucket("numbers")
+	for i := 0; i < 20; i++ {
+		if err := b.Put([]byte(fmt.Sprintf("%02d", i)), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.DeleteRange([]byte("05"), []byte("10")); err != nil {
+		t.Fatal(err)
+	}
+
+	// write the nodes and the freelist like Commit, but stop before the
+	// meta page as if the process died
+	b.spill()
+	for _, node := range b.nodes {
+		if node.dirty {
+			if err := db.writeNode(node); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := db.writeFreelist(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		value, err := mustBucket(t, db, "numbers").Get([]byte(fmt.Sprintf("%02d", i)))
+		if err != nil || string(value) != "old" {
+			t.Fatalf("expected key %02d to be old but got %q, %v", i, value, err)
+		}
+	}
+
+	if problems := db.Check(); len(problems) > 0 {
+		t.Fatalf("expected no problems but got %v", problems)
+	}
+}
+
+func TestTxReadOnly(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	mustBucket(t, db, "user_emails")
+
+	err = db.View(func(tx *Tx) error {
+		return tx.Bucket("user_emails").Put([]byte("Ahmed"), []byte("ahmed@email.com"))
+	})
+	if err != ErrTxNotWritable {
+		t.Fatalf("expected %v but got %v", ErrTxNotWritable, err)
+	}
+}
+
+func TestDBBatch(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 3, MaxBatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	errOdd := errors.New("odd")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = db.Batch(func(tx *Tx) error {
+				key := []byte(fmt.Sprintf("key%02d", i))
+				if err := tx.Bucket("batch").Put(key, key); err != nil {
+					return err
+				}
+
+				// every odd call fails, the rest of its batch must still commit
+				if i%2 == 1 {
+					return errOdd
+				}
+
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if i%2 == 1 && err != errOdd {
+			t.Fatalf("call %d: expected %v but got %v", i, errOdd, err)
+		}
+		if i%2 == 0 && err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+
+	count := 0
+	mustBucket(t, db, "batch").Scan(func(key, value []byte) bool {
+		count++
+		return true
+	})
+
+	if count != 25 {
+		t.Fatalf("expected 25 keys but got %d", count)
+	}
+}
+
+func TestBucketSequence(t *testing.T) {
+	path := tempDBPath(t)
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bucket := mustBucket(t, db, "users")
+	for i := uint64(1); i <= 3; i++ {
+		id, err := bucket.NextSequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id != i {
+			t.Fatalf("expected id %d but got %d", i, id)
+		}
+	}
+
+	// a rolled back transaction does not move the sequence
+	errAbort := errors.New("abort")
+	err = db.Update(func(tx *Tx) error {
+		if _, err := tx.Bucket("users").NextSequence(); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("expected abort error but got %v", err)
+	}
+
+	sequence, err := bucket.Sequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sequence != 3 {
+		t.Fatalf("expected sequence 3 after rollback but got %d", sequence)
+	}
+
+	if err := bucket.SetSequence(10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	id, err := mustBucket(t, db, "users").NextSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != 11 {
+		t.Fatalf("expected id 11 after reopen but got %d", id)
+	}
+}
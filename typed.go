@@ -0,0 +1,105 @@
+package kvdb
+
+// TypedBucket reads and writes a bucket with keys of type K and values of
+// type V, encoded by codecs. keys are scanned in the order of their encoded
+// bytes, so the key codec must keep the order of K, see Codec
+type TypedBucket[K, V any] struct {
+	bucket *Bucket
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewTypedBucket wraps b. b can be a handle from DB.Bucket or one bound to a
+// transaction from Tx.Bucket
+func NewTypedBucket[K, V any](b *Bucket, keys Codec[K], values Codec[V]) *TypedBucket[K, V] {
+	return &TypedBucket[K, V]{bucket: b, keys: keys, values: values}
+}
+
+// Bucket returns the wrapped bucket
+func (t *TypedBucket[K, V]) Bucket() *Bucket {
+	return t.bucket
+}
+
+func (t *TypedBucket[K, V]) Put(key K, value V) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+
+	v, err := t.values.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	return t.bucket.Put(k, v)
+}
+
+// Get returns the value of key, ErrKeyNotFound if it does not exist
+func (t *TypedBucket[K, V]) Get(key K) (V, error) {
+	var value V
+
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return value, err
+	}
+
+	v, err := t.bucket.Get(k)
+	if err != nil {
+		return value, err
+	}
+
+	return t.values.Decode(v)
+}
+
+func (t *TypedBucket[K, V]) Delete(key K) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+
+	return t.bucket.Delete(k)
+}
+
+// Scan calls f for every key in order until f returns false. it stops with
+// the error of a key or value that cannot be decoded
+func (t *TypedBucket[K, V]) Scan(f func(key K, value V) bool) error {
+	return t.scan(nil, nil, f)
+}
+
+// ScanRange calls f for every key in [start, end) in order until f returns
+// false
+func (t *TypedBucket[K, V]) ScanRange(start K, end K, f func(key K, value V) bool) error {
+	s, err := t.keys.Encode(start)
+	if err != nil {
+		return err
+	}
+
+	e, err := t.keys.Encode(end)
+	if err != nil {
+		return err
+	}
+
+	return t.scan(s, e, f)
+}
+
+func (t *TypedBucket[K, V]) scan(start []byte, end []byte, f func(key K, value V) bool) error {
+	var err error
+	scanErr := t.bucket.ScanRange(start, end, func(k []byte, v []byte) bool {
+		var key K
+		if key, err = t.keys.Decode(k); err != nil {
+			return false
+		}
+
+		var value V
+		if value, err = t.values.Decode(v); err != nil {
+			return false
+		}
+
+		return f(key, value)
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+
+	return err
+}
@@ -0,0 +1,161 @@
+package kvdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+type user struct {
+	Name string
+	Age  int
+}
+
+func TestTypedBucket(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	users := NewTypedBucket[int64, user](mustBucket(t, db, "users"), IntKey[int64]{}, JSONCodec[user]{})
+	for _, id := range []int64{5, -3, 0, 100, -100} {
+		if err := users.Put(id, user{Name: fmt.Sprintf("user%d", id), Age: int(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, err := users.Get(-3)
+	if err != nil || u.Name != "user-3" {
+		t.Fatalf("expected user-3 but got %+v %v", u, err)
+	}
+
+	if _, err := users.Get(7); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound but got %v", err)
+	}
+
+	var ids []int64
+	err = users.Scan(func(id int64, u user) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil || fmt.Sprint(ids) != "[-100 -3 0 5 100]" {
+		t.Fatalf("expected the ids in numeric order but got %v %v", ids, err)
+	}
+
+	ids = nil
+	err = users.ScanRange(-3, 5, func(id int64, u user) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil || fmt.Sprint(ids) != "[-3 0]" {
+		t.Fatalf("expected the ids in [-3, 5) but got %v %v", ids, err)
+	}
+
+	if err := users.Delete(0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a value that cannot be decoded stops the scan
+	key, _ := IntKey[int64]{}.Encode(1)
+	if err := mustBucket(t, db, "users").Put(key, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Scan(func(int64, user) bool { return true }); err == nil {
+		t.Fatal("expected the scan to fail on an invalid value")
+	}
+
+	// typed buckets work inside transactions
+	err = db.Update(func(tx *Tx) error {
+		events := NewTypedBucket[Pair[string, time.Time], string](tx.Bucket("events"), PairKey[string, time.Time]{StringKey{}, TimeKey{}}, JSONCodec[string]{})
+		return events.Put(Pair[string, time.Time]{"login", time.Unix(10, 0)}, "ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkOrder encodes values, which are in order, and checks the encoded keys
+// are in the same order and decode to the values
+func checkOrder[T any](t *testing.T, codec Codec[T], values []T) {
+	t.Helper()
+
+	var keys [][]byte
+	for _, v := range values {
+		key, err := codec.Encode(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+
+		decoded, err := codec.Decode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(decoded) != fmt.Sprint(v) {
+			t.Fatalf("expected %v to decode to itself but got %v", v, decoded)
+		}
+	}
+
+	if !sort.SliceIsSorted(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 }) {
+		t.Fatalf("expected the keys of %v to be in order but got %x", values, keys)
+	}
+}
+
+func TestKeyCodecsKeepOrder(t *testing.T) {
+	checkOrder[int64](t, IntKey[int64]{}, []int64{-1 << 63, -256, -1, 0, 1, 255, 256, 1<<63 - 1})
+	checkOrder[int8](t, IntKey[int8]{}, []int8{-128, -1, 0, 127})
+	checkOrder[uint32](t, UintKey[uint32]{}, []uint32{0, 1, 255, 256, 1<<32 - 1})
+	checkOrder[string](t, StringKey{}, []string{"", "a", "a\x00", "ab", "b"})
+	checkOrder[time.Time](t, TimeKey{}, []time.Time{
+		time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC),
+		time.Unix(0, 0).UTC(),
+		time.Date(2024, 2, 29, 12, 0, 0, 1, time.UTC),
+	})
+
+	// a shorter first value sorts first, whatever comes after it
+	checkOrder[Pair[string, int64]](t, PairKey[string, int64]{StringKey{}, IntKey[int64]{}}, []Pair[string, int64]{
+		{"", 5},
+		{"a", -1},
+		{"a", 7},
+		{"a\x00", -5},
+		{"a\x00b", 0},
+		{"a\x01", 0},
+		{"b", -100},
+	})
+	checkOrder[Pair[string, string]](t, PairKey[string, string]{StringKey{}, StringKey{}}, []Pair[string, string]{
+		{"a", "\xff"},
+		{"a\x00", ""},
+	})
+
+	if _, err := (PairKey[string, string]{StringKey{}, StringKey{}}).Decode([]byte("abc")); err == nil {
+		t.Fatal("expected a pair without terminator to be rejected")
+	}
+}
+
+func TestValueCodecs(t *testing.T) {
+	type point struct {
+		X, Y int32
+	}
+
+	p := point{X: -1, Y: 2}
+	for _, codec := range []Codec[point]{JSONCodec[point]{}, GobCodec[point]{}, BinaryCodec[point]{}} {
+		data, err := codec.Encode(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := codec.Decode(data)
+		if err != nil || decoded != p {
+			t.Fatalf("%T: expected %+v but got %+v %v", codec, p, decoded, err)
+		}
+	}
+
+	if _, err := (BinaryCodec[point]{}).Decode([]byte{1}); err == nil {
+		t.Fatal("expected a short value to be rejected")
+	}
+}
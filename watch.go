@@ -0,0 +1,159 @@
+package kvdb
+
+import (
+	"bytes"
+	"sync"
+)
+
+type EventType uint8
+
+const (
+	EventPut    EventType = 1
+	EventDelete EventType = 2
+)
+
+// Event is a change of a key made by a committed transaction
+type Event struct {
+	Seq    uint64 // position in the change log, 0 without Config.ChangeLog
+	TxID   uint64
+	Type   EventType
+	Bucket string
+	Key    []byte
+	Before []byte // value before the change, nil if the key did not exist
+	After  []byte // value after the change, nil for deletes
+}
+
+// watchBufferSize is how many events a watcher can fall behind before it
+// is dropped
+const watchBufferSize = 1024
+
+type watcher struct {
+	bucket string
+	prefix []byte
+	events chan Event
+	closed bool
+}
+
+// Watch returns a channel receiving the changes of the keys starting with
+// prefix in the bucket, an empty prefix watches every key and an empty
+// bucket name every bucket. events are sent after the transaction that made
+// them commits, in commit order, and only for transactions that started
+// after Watch returned.
+//
+// the channel buffers the events of a watcher that falls behind. once the
+// buffer is full the watcher is dropped and the channel closed, commits never
+// wait for a slow watcher. a watcher whose channel was closed missed events
+// and must read the bucket again before watching it again. the returned
+// function stops watching and closes the channel
+func (db *DB) Watch(bucket string, prefix []byte) (<-chan Event, func()) {
+	w := &watcher{
+		bucket: bucket,
+		prefix: append([]byte{}, prefix...),
+		events: make(chan Event, watchBufferSize),
+	}
+
+	// wait for the running writable transaction, so every transaction that
+	// starts from now on records its changes for the watcher
+	db.rwlock.RLock()
+	db.watchMu.Lock()
+	db.watchers = append(db.watchers, w)
+	db.watchMu.Unlock()
+	db.rwlock.RUnlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			db.watchMu.Lock()
+			defer db.watchMu.Unlock()
+
+			db.unwatch(w)
+		})
+	}
+
+	return w.events, cancel
+}
+
+// unwatch drops the watcher and closes its channel, watchMu must be held
+func (db *DB) unwatch(w *watcher) {
+	for i, other := range db.watchers {
+		if other == w {
+			db.watchers = append(db.watchers[:i], db.watchers[i+1:]...)
+			break
+		}
+	}
+
+	if !w.closed {
+		w.closed = true
+		close(w.events)
+	}
+}
+
+// watching reports whether transactions must record their changes
+func (db *DB) watching() bool {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+
+	return len(db.watchers) > 0
+}
+
+// notify sends the changes of a committed transaction to the watchers. it is
+// called by Commit before the lock is released, so events keep commit order
+func (db *DB) notify(changes []Event) {
+	if len(changes) == 0 {
+		return
+	}
+
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+
+	for _, w := range append([]*watcher{}, db.watchers...) {
+		for _, event := range changes {
+			if (w.bucket != "" && event.Bucket != w.bucket) || !bytes.HasPrefix(event.Key, w.prefix) {
+				continue
+			}
+
+			select {
+			case w.events <- event:
+			default:
+				// the watcher fell too far behind
+				db.unwatch(w)
+			}
+
+			if w.closed {
+				break
+			}
+		}
+	}
+}
+
+// changed updates the indexes of the bucket with a change and records it
+func (b *Bucket) changed(typ EventType, key []byte, before []byte, after []byte) {
+	b.updateIndexes(typ, key, before, after)
+	b.record(typ, key, before, after)
+}
+
+// record keeps a change of a user bucket so it can be sent to watchers once
+// the transaction commits
+func (b *Bucket) record(typ EventType, key []byte, before []byte, after []byte) {
+	if !b.tx.recording || isInternalBucket(b.name) {
+		return
+	}
+
+	b.tx.changes = append(b.tx.changes, Event{
+		TxID:   b.tx.id,
+		Type:   typ,
+		Bucket: b.name,
+		Key:    clone(key),
+		Before: clone(before),
+		After:  clone(after),
+	})
+}
+
+// clone copies b so later changes to b do not show in events, nil stays nil
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
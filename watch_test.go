@@ -0,0 +1,165 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDBWatch(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "users")
+	if err := bucket.Put([]byte("user:1"), []byte("before watch")); err != nil {
+		t.Fatal(err)
+	}
+
+	events, cancel := db.Watch("users", []byte("user:"))
+	defer cancel()
+
+	if err := bucket.Put([]byte("user:1"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("admin:1"), []byte("not watched")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mustBucket(t, db, "other").Put([]byte("user:1"), []byte("not watched")); err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	db.Update(func(tx *Tx) error {
+		tx.Bucket("users").Put([]byte("user:9"), []byte("rolled back"))
+		return errAbort
+	})
+
+	err = db.Update(func(tx *Tx) error {
+		b := tx.Bucket("users")
+		for i := 2; i <= 4; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("user:%d", i)), []byte("b")); err != nil {
+				return err
+			}
+		}
+		return b.Delete([]byte("user:1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bucket.DeletePrefix([]byte("user:")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"put user:1 before watch -> a",
+		"put user:2  -> b",
+		"put user:3  -> b",
+		"put user:4  -> b",
+		"delete user:1 a -> ",
+		"delete user:2 b -> ",
+		"delete user:3 b -> ",
+		"delete user:4 b -> ",
+	}
+
+	var txids []uint64
+	for _, text := range expected {
+		event := <-events
+		typ := "put"
+		if event.Type == EventDelete {
+			typ = "delete"
+		}
+
+		actual := fmt.Sprintf("%s %s %s -> %s", typ, event.Key, event.Before, event.After)
+		if actual != text {
+			t.Fatalf("expected event %q but got %q", text, actual)
+		}
+		txids = append(txids, event.TxID)
+	}
+
+	// the put, the transaction and the prefix delete
+	if txids[0] >= txids[1] || txids[1] != txids[4] || txids[4] >= txids[5] {
+		t.Fatalf("unexpected transaction ids %v", txids)
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %+v", event)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("expected the channel to be closed after cancel")
+	}
+}
+
+func TestDBWatchSlowConsumer(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	slow, cancelSlow := db.Watch("numbers", nil)
+	defer cancelSlow()
+
+	err = db.Update(func(tx *Tx) error {
+		b := tx.Bucket("numbers")
+		for i := 0; i < watchBufferSize+1; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%05d", i)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the buffered events are still delivered before the channel is closed
+	count := 0
+	for range slow {
+		count++
+	}
+
+	if count != watchBufferSize {
+		t.Fatalf("expected %d events before the channel was closed but got %d", watchBufferSize, count)
+	}
+
+	// the dropped watcher does not make transactions record changes anymore
+	if db.watching() {
+		t.Fatal("expected no watchers left")
+	}
+}
+
+func TestDBWatchUpdate(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	bucket := mustBucket(t, db, "users")
+	if err := bucket.Put([]byte("user:1"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	events, cancel := db.Watch("users", []byte("user:"))
+	defer cancel()
+
+	if err := bucket.Update([]byte("user:1"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-events
+	if event.Type != EventPut || string(event.Key) != "user:1" || string(event.Before) != "a" || string(event.After) != "b" {
+		t.Fatalf("expected the update of user:1 from a to b but got %+v", event)
+	}
+}
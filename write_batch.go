@@ -0,0 +1,193 @@
+package kvdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	writeBatchPut         = 0x01
+	writeBatchDelete      = 0x02
+	writeBatchDeleteRange = 0x03
+)
+
+// WriteBatch collects writes across buckets without touching the database.
+// DB.Write applies all of them in one transaction, or none of them if one
+// fails. a WriteBatch can be serialized with MarshalBinary to be stored or
+// sent somewhere else and applied later.
+//
+// the zero value is an empty batch ready to use
+type WriteBatch struct {
+	ops []writeBatchOp
+}
+
+type writeBatchOp struct {
+	typ    uint8
+	bucket string
+	key    []byte // start key for delete range
+	value  []byte // end key for delete range
+}
+
+// Put adds a write of value under key, like Bucket.Put
+func (wb *WriteBatch) Put(bucket string, key []byte, value []byte) {
+	wb.add(writeBatchPut, bucket, key, value)
+}
+
+// Delete adds a removal of key, like Bucket.Delete. applying the batch fails
+// if key does not exist
+func (wb *WriteBatch) Delete(bucket string, key []byte) {
+	wb.add(writeBatchDelete, bucket, key, nil)
+}
+
+// DeleteRange adds a removal of every key in [start, end), like
+// Bucket.DeleteRange. an empty end means up to the last key of the bucket
+func (wb *WriteBatch) DeleteRange(bucket string, start []byte, end []byte) {
+	wb.add(writeBatchDeleteRange, bucket, start, end)
+}
+
+// Len returns the number of writes in the batch
+func (wb *WriteBatch) Len() int {
+	return len(wb.ops)
+}
+
+// Reset empties the batch so it can be reused
+func (wb *WriteBatch) Reset() {
+	wb.ops = wb.ops[:0]
+}
+
+func (wb *WriteBatch) add(typ uint8, bucket string, key []byte, value []byte) {
+	// copy the slices so callers can reuse their buffers
+	wb.ops = append(wb.ops, writeBatchOp{
+		typ:    typ,
+		bucket: bucket,
+		key:    append([]byte{}, key...),
+		value:  append([]byte{}, value...),
+	})
+}
+
+// Write applies every write of the batch atomically, in the order they were
+// added
+func (db *DB) Write(wb *WriteBatch) error {
+	return db.Update(func(tx *Tx) error {
+		return wb.apply(tx)
+	})
+}
+
+func (wb *WriteBatch) apply(tx *Tx) error {
+	for _, op := range wb.ops {
+		bucket := tx.Bucket(op.bucket)
+
+		var err error
+		switch op.typ {
+		case writeBatchPut:
+			err = bucket.Put(op.key, op.value)
+		case writeBatchDelete:
+			err = bucket.Delete(op.key)
+		case writeBatchDeleteRange:
+			_, err = bucket.DeleteRange(op.key, op.value)
+		}
+
+		if err != nil {
+			return fmt.Errorf("bucket %s key %s: %w", op.bucket, op.key, err)
+		}
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the batch as
+//
+//	number of writes, then for every write
+//	type, bucket name, key and value, each prefixed by its length
+//
+// with every number encoded as a uvarint
+func (wb *WriteBatch) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(wb.ops)))
+
+	for _, op := range wb.ops {
+		buf = append(buf, op.typ)
+		buf = appendBytes(buf, []byte(op.bucket))
+		buf = appendBytes(buf, op.key)
+		buf = appendBytes(buf, op.value)
+	}
+
+	return buf, nil
+}
+
+// minWriteBatchOpSize is the size of an encoded write with an empty bucket
+// name, key and value: the type and three lengths of one byte
+const minWriteBatchOpSize = 4
+
+// UnmarshalBinary replaces the content of the batch with the one encoded
+// by MarshalBinary
+func (wb *WriteBatch) UnmarshalBinary(data []byte) error {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return fmt.Errorf("invalid write batch")
+	}
+	data = data[n:]
+
+	// the count comes from the input, it is only trusted once every write
+	// it claims can fit in the bytes left
+	if count > uint64(len(data)/minWriteBatchOpSize) {
+		return fmt.Errorf("invalid write batch, %d writes do not fit in %d bytes", count, len(data))
+	}
+
+	ops := make([]writeBatchOp, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(data) == 0 {
+			return fmt.Errorf("invalid write batch")
+		}
+
+		op := writeBatchOp{typ: data[0]}
+		if op.typ != writeBatchPut && op.typ != writeBatchDelete && op.typ != writeBatchDeleteRange {
+			return fmt.Errorf("invalid write batch, unknown write type %d", op.typ)
+		}
+		data = data[1:]
+
+		var bucket []byte
+		var err error
+		if bucket, data, err = readBytes(data); err != nil {
+			return fmt.Errorf("invalid write batch, bucket of write %d: %w", i, err)
+		}
+		if op.key, data, err = readBytes(data); err != nil {
+			return fmt.Errorf("invalid write batch, key of write %d: %w", i, err)
+		}
+		if op.value, data, err = readBytes(data); err != nil {
+			return fmt.Errorf("invalid write batch, value of write %d: %w", i, err)
+		}
+		op.bucket = string(bucket)
+
+		ops = append(ops, op)
+	}
+
+	if len(data) > 0 {
+		return fmt.Errorf("invalid write batch, %d trailing bytes", len(data))
+	}
+
+	wb.ops = ops
+
+	return nil
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// errShortBuffer is returned by readBytes when data ends before the bytes
+// it holds, callers tell what they were reading
+var errShortBuffer = errors.New("bytes cut short")
+
+// readBytes reads bytes stored by appendBytes and returns the rest of data
+func readBytes(data []byte) ([]byte, []byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, nil, errShortBuffer
+	}
+
+	data = data[n:]
+
+	return append([]byte{}, data[:size]...), data[size:], nil
+}
@@ -0,0 +1,113 @@
+package kvdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDBWrite(t *testing.T) {
+	db, err := Open(tempDBPath(t), &Config{maxKeysPerNode: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var wb WriteBatch
+	for i := 0; i < 20; i++ {
+		wb.Put("numbers", []byte(fmt.Sprintf("%02d", i)), []byte(fmt.Sprint(i)))
+	}
+	wb.Put("countries", []byte("Egypt"), []byte("Cairo"))
+	wb.Delete("numbers", []byte("00"))
+	wb.DeleteRange("numbers", []byte("05"), []byte("15"))
+
+	// ship the batch through its binary form before applying it
+	data, err := wb.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded WriteBatch
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Len() != wb.Len() {
+		t.Fatalf("expected %d writes but got %d", wb.Len(), decoded.Len())
+	}
+
+	if err := db.Write(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	mustBucket(t, db, "numbers").Scan(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+
+	expected := []string{"01", "02", "03", "04", "15", "16", "17", "18", "19"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Fatalf("expected keys %v but got %v", expected, keys)
+	}
+
+	value, err := mustBucket(t, db, "countries").Get([]byte("Egypt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(value) != "Cairo" {
+		t.Fatalf("expected Cairo but got %s", value)
+	}
+}
+
+func TestDBWriteIsAtomic(t *testing.T) {
+	db, err := Open(tempDBPath(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	var wb WriteBatch
+	wb.Put("countries", []byte("Egypt"), []byte("Cairo"))
+	wb.Delete("countries", []byte("Algeria")) // does not exist
+
+	if err := db.Write(&wb); err == nil {
+		t.Fatal("expected error but got nil")
+	}
+
+	_, err = mustBucket(t, db, "countries").Get([]byte("Egypt"))
+	if err == nil {
+		t.Fatal("expected Egypt to be rolled back")
+	}
+
+	wb.Reset()
+	wb.DeleteRange("countries", nil, nil)
+	if err := db.Write(&wb); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBatchUnmarshalInvalid(t *testing.T) {
+	var wb WriteBatch
+	wb.Put("countries", []byte("Egypt"), []byte("Cairo"))
+
+	data, err := wb.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wb.UnmarshalBinary(data[:len(data)-1])
+	if !errors.Is(err, errShortBuffer) || !strings.HasPrefix(err.Error(), "invalid write batch") {
+		t.Fatalf("expected error for truncated batch but got %v", err)
+	}
+
+	// a count larger than the input must not be allocated
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	if err := wb.UnmarshalBinary(huge); err == nil {
+		t.Fatal("expected error for a count larger than the batch but got nil")
+	}
+}